@@ -0,0 +1,616 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package client is a Go client for the proxi server's rest api.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURL is the url of a server started with the default listen address.
+	DefaultURL = "http://localhost:4444"
+	// APIKeyHeader is the header api keys are sent in.
+	APIKeyHeader = "X-API-Key"
+)
+
+var (
+	// ErrNotFound is returned by Find when the server has no record of the proxy.
+	ErrNotFound = errors.New("proxy not found")
+	// ErrBusy is returned by Refresh when the server is already downloading or checking proxies.
+	ErrBusy = errors.New("server is busy downloading or checking proxies")
+)
+
+// Proxy is a proxy record returned by the server.
+type Proxy struct {
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	CheckedAt    *time.Time `json:"checked_at"`
+	NextCheckAt  *time.Time `json:"next_check_at"`
+	RespTime     *string    `json:"response_time"`
+	CheckCount   uint       `json:"check_count"`
+	Country      string     `json:"country"`
+	FailCount    uint       `json:"fail_count"`
+	LastStatus   string     `json:"last_status"`
+	LastError    string     `json:"last_error"`
+	Proxy        string     `json:"proxy"`
+	TimeoutCount uint       `json:"timeout_count"`
+	Source       string     `json:"source"`
+	SuccessCount uint       `json:"success_count"`
+	Anonymous    bool       `json:"anonymous"`
+	ReportOK     uint       `json:"report_ok"`
+	ReportFail   uint       `json:"report_fail"`
+	ASN          uint       `json:"asn"`
+	Org          string     `json:"org"`
+	NetworkType  string     `json:"type"`
+	City         string     `json:"city"`
+	Subdivision  string     `json:"subdivision"`
+	ExitIP       string     `json:"exit_ip"`
+	ExitCountry  string     `json:"exit_country"`
+	ExitDiffers  bool       `json:"exit_differs"`
+	// Blocked is the blocklist the proxy is on, or deny. It's empty if the proxy isn't blocked.
+	Blocked string `json:"blocked"`
+}
+
+// Proxies is a slice of Proxy
+type Proxies []*Proxy
+
+// TableStats are the pool counts returned by Stats.
+type TableStats struct {
+	Anon            int   `json:"anon"`
+	Good            int   `json:"good"`
+	Timeout         int   `json:"timeout"`
+	Total           int   `json:"total"`
+	RecentlyChecked int64 `json:"recently_checked"`
+}
+
+// Usage is a client's request and proxy counts from Usage.
+type Usage struct {
+	Client       string  `json:"client"`
+	Day          string  `json:"day"`
+	Requests     int64   `json:"requests_today"`
+	Limited      int64   `json:"limited_today"`
+	Proxies      int64   `json:"proxies_today"`
+	TotalProxies int64   `json:"proxies_total"`
+	RateLimit    float64 `json:"rate_limit"`
+	DailyQuota   int64   `json:"daily_quota"`
+}
+
+// Job is a scheduled server job from Schedule.
+type Job struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	NextRun  time.Time  `json:"next_run"`
+	LastRun  *time.Time `json:"last_run"`
+	Running  bool       `json:"running"`
+}
+
+// Worker is a checker from Workers.
+type Worker struct {
+	Name     string    `json:"name"`
+	Region   string    `json:"region"`
+	LastSeen time.Time `json:"last_seen"`
+	Checked  int64     `json:"checked"`
+	Good     int64     `json:"good"`
+}
+
+// Health is a server's status and whether it leads the replicas.
+type Health struct {
+	Status      string     `json:"status"`
+	Replica     string     `json:"replica"`
+	Leader      bool       `json:"leader"`
+	HA          bool       `json:"ha"`
+	LeaderSince *time.Time `json:"leader_since"`
+}
+
+// Readiness is whether a server can serve proxies, and the problems if not.
+type Readiness struct {
+	Ready    bool     `json:"ready"`
+	Leader   bool     `json:"leader"`
+	DB       string   `json:"db"`
+	Judge    string   `json:"judge"`
+	Good     int64    `json:"good"`
+	MinGood  int64    `json:"min_good"`
+	Problems []string `json:"problems"`
+}
+
+// Task is a proxy leased to a worker to check.
+type Task struct {
+	ID    uint   `json:"id"`
+	Proxy string `json:"proxy"`
+}
+
+// TaskResult is the outcome of checking a Task. Status is good, fail, timeout or error when the judge failed.
+type TaskResult struct {
+	ID        uint   `json:"id"`
+	Status    string `json:"status"`
+	Anonymous bool   `json:"anonymous"`
+	LatencyMs int64  `json:"latency_ms"`
+	// ExitIP is the address the judge saw the check come from.
+	ExitIP string `json:"exit_ip"`
+	// Error is why the check failed, starting with its kind, eg "connection_refused: ...".
+	Error string `json:"error,omitempty"`
+}
+
+// Event is a pool change or job progress event from Events. Data is the proxy for proxy events
+// and the checked, total and good counts for job events.
+type Event struct {
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Filter selects proxies. Zero values don't filter.
+type Filter struct {
+	// Anon only returns anonymous proxies when true.
+	Anon      bool
+	Countries []string
+	// ExitCountries only returns proxies whose exit ip is in one of the countries.
+	ExitCountries []string
+	// Status defaults to good for Get and GetN.
+	Status     []string
+	Sources    []string
+	Protocols  []string
+	MinSuccess uint
+	// CheckedSince only returns proxies checked within this long ago.
+	CheckedSince time.Duration
+	MaxLatency   time.Duration
+	// Regions only returns proxies a worker in one of the regions last found good.
+	Regions      []string
+	ASNs         []uint
+	Cities       []string
+	Subdivisions []string
+	// Types are network types: hosting, residential or mobile.
+	Types []string
+	// Sort is a field name, prefixed with '-' for descending order. Only used by List.
+	Sort string
+	// IncludeBlocked includes proxies on a blocklist or the server's deny list.
+	IncludeBlocked bool
+}
+
+// Page is the pagination for List. Cursor pagination is used when UseCursor is set.
+type Page struct {
+	Limit     int
+	Offset    int
+	UseCursor bool
+	Cursor    string
+}
+
+// ListResult is a page of proxies from List.
+type ListResult struct {
+	Proxies Proxies
+	// Total is the number of proxies matching the filter.
+	Total int64
+	// NextCursor continues cursor pagination. It's empty on the last page.
+	NextCursor string
+}
+
+// APIError is returned when the server responds with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("proxi: %d %v: %v", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client is a proxi api client.
+type Client struct {
+	// BaseURL is the url of the server, eg http://localhost:4444.
+	BaseURL string
+	// APIKey is sent with each request when set.
+	APIKey string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), APIKey: apiKey}
+}
+
+func (f *Filter) values() url.Values {
+	v := url.Values{}
+	if f == nil {
+		return v
+	}
+	if f.Anon {
+		v.Set("anon", "")
+	}
+	for _, c := range f.Countries {
+		v.Add("country", c)
+	}
+	for _, c := range f.ExitCountries {
+		v.Add("exit_country", c)
+	}
+	for _, s := range f.Status {
+		v.Add("status", s)
+	}
+	for _, s := range f.Sources {
+		v.Add("source", s)
+	}
+	for _, p := range f.Protocols {
+		v.Add("protocol", p)
+	}
+	for _, r := range f.Regions {
+		v.Add("region", r)
+	}
+	for _, a := range f.ASNs {
+		v.Add("asn", strconv.FormatUint(uint64(a), 10))
+	}
+	for _, t := range f.Types {
+		v.Add("type", t)
+	}
+	for _, c := range f.Cities {
+		v.Add("city", c)
+	}
+	for _, s := range f.Subdivisions {
+		v.Add("subdivision", s)
+	}
+	if f.IncludeBlocked {
+		v.Set("include_blocked", "")
+	}
+	if f.MinSuccess > 0 {
+		v.Set("min_success", strconv.FormatUint(uint64(f.MinSuccess), 10))
+	}
+	if f.CheckedSince > 0 {
+		v.Set("checked_since", f.CheckedSince.String())
+	}
+	if f.MaxLatency > 0 {
+		v.Set("max_latency", f.MaxLatency.String())
+	}
+	return v
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends a request and returns the response if it has a 2xx status, otherwise an *APIError.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, form url.Values) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return c.send(ctx, req)
+}
+
+// postJSON posts in as json to path and decodes the response into out.
+func (c *Client) postJSON(ctx context.Context, path string, in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.BaseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends req with the api key and returns the response if it has a 2xx status, otherwise an *APIError.
+func (c *Client) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	if c.APIKey != "" {
+		req.Header.Set(APIKeyHeader, c.APIKey)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &e) == nil && e.Error != "" {
+		apiErr.Message = e.Error
+	}
+	return nil, apiErr
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.do(ctx, "GET", path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Get returns a random proxy matching f, or nil if there are none.
+func (c *Client) Get(ctx context.Context, f *Filter) (*Proxy, error) {
+	var p *Proxy
+	err := c.getJSON(ctx, "/get", f.values(), &p)
+	return p, err
+}
+
+// GetN returns up to n random proxies matching f.
+func (c *Client) GetN(ctx context.Context, n int, f *Filter) (Proxies, error) {
+	var p Proxies
+	err := c.getJSON(ctx, fmt.Sprintf("/get/%d", n), f.values(), &p)
+	return p, err
+}
+
+// GetAll returns every proxy, including ones that failed checks or were deleted.
+func (c *Client) GetAll(ctx context.Context) (Proxies, error) {
+	var p Proxies
+	err := c.getJSON(ctx, "/getall", nil, &p)
+	return p, err
+}
+
+// List returns a page of proxies matching f in a stable order.
+func (c *Client) List(ctx context.Context, f *Filter, page Page) (*ListResult, error) {
+	v := f.values()
+	if f != nil && f.Sort != "" {
+		v.Set("sort", f.Sort)
+	}
+	if page.Limit > 0 {
+		v.Set("limit", strconv.Itoa(page.Limit))
+	}
+	if page.Offset > 0 {
+		v.Set("offset", strconv.Itoa(page.Offset))
+	}
+	if page.UseCursor {
+		v.Set("cursor", page.Cursor)
+	}
+	resp, err := c.do(ctx, "GET", "/proxies", v, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res ListResult
+	if err := json.NewDecoder(resp.Body).Decode(&res.Proxies); err != nil {
+		return nil, err
+	}
+	res.Total, _ = strconv.ParseInt(resp.Header.Get("X-Total-Count"), 10, 64)
+	res.NextCursor = resp.Header.Get("X-Next-Cursor")
+	return &res, nil
+}
+
+// Find returns the record for a proxy, eg http://1.2.3.4:8080, or ErrNotFound.
+func (c *Client) Find(ctx context.Context, proxy string) (*Proxy, error) {
+	resp, err := c.do(ctx, "POST", "/find", nil, url.Values{"proxy": {proxy}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var p *Proxy
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+// Delete deletes a proxy and returns the number of records deleted.
+func (c *Client) Delete(ctx context.Context, proxy string) (int64, error) {
+	resp, err := c.do(ctx, "POST", "/delete", nil, url.Values{"proxy": {proxy}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Deleted int64 `json:"deleted"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Deleted, err
+}
+
+// Report records whether a request through proxy succeeded.
+func (c *Client) Report(ctx context.Context, proxy string, ok bool) error {
+	resp, err := c.do(ctx, "POST", "/report", nil, url.Values{"proxy": {proxy}, "ok": {strconv.FormatBool(ok)}})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Import adds proxies to the pool to be checked with the next check cycle and returns the number imported.
+// Proxies without a scheme are assumed to be http. source defaults to import.
+func (c *Client) Import(ctx context.Context, proxies []string, source string) (int, error) {
+	form := url.Values{"proxy": proxies}
+	if source != "" {
+		form.Set("source", source)
+	}
+	resp, err := c.do(ctx, "POST", "/import", nil, form)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Imported int `json:"imported"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Imported, err
+}
+
+// Stats returns the pool counts.
+func (c *Client) Stats(ctx context.Context) (*TableStats, error) {
+	var s TableStats
+	if err := c.getJSON(ctx, "/stats", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Usage returns the caller's usage, or every client's usage for admin keys and servers without auth.
+func (c *Client) Usage(ctx context.Context) ([]*Usage, error) {
+	var u []*Usage
+	err := c.getJSON(ctx, "/usage", nil, &u)
+	return u, err
+}
+
+// Schedule returns the server's scheduled jobs in the order they run next.
+func (c *Client) Schedule(ctx context.Context) ([]*Job, error) {
+	var jobs []*Job
+	err := c.getJSON(ctx, "/schedule", nil, &jobs)
+	return jobs, err
+}
+
+// Lease returns up to n proxies for worker in region to check. They're leased to the worker for 10 minutes,
+// after which they can be handed to another worker in the region. It needs a worker or admin api key.
+func (c *Client) Lease(ctx context.Context, worker, region string, n int) ([]*Task, error) {
+	var tasks []*Task
+	err := c.postJSON(ctx, "/worker/lease", map[string]interface{}{"worker": worker, "region": region, "limit": n}, &tasks)
+	return tasks, err
+}
+
+// SubmitResults posts the results of leased tasks.
+func (c *Client) SubmitResults(ctx context.Context, worker, region string, results []*TaskResult) error {
+	var res struct {
+		Recorded int `json:"recorded"`
+	}
+	return c.postJSON(ctx, "/worker/results", map[string]interface{}{"worker": worker, "region": region, "results": results}, &res)
+}
+
+// Workers returns the workers that have checked proxies for the server.
+func (c *Client) Workers(ctx context.Context) ([]*Worker, error) {
+	var workers []*Worker
+	err := c.getJSON(ctx, "/workers", nil, &workers)
+	return workers, err
+}
+
+// Health returns the server's status.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var h Health
+	err := c.getJSON(ctx, "/health", nil, &h)
+	return &h, err
+}
+
+// Live returns nil if the server is serving requests.
+func (c *Client) Live(ctx context.Context) error {
+	var out struct{}
+	return c.getJSON(ctx, "/healthz", nil, &out)
+}
+
+// Ready returns the server's readiness. A server that isn't ready answers 503, which isn't an error here.
+func (c *Client) Ready(ctx context.Context) (*Readiness, error) {
+	var r Readiness
+	err := c.getJSON(ctx, "/readyz", nil, &r)
+	if e, ok := err.(*APIError); ok && e.StatusCode == http.StatusServiceUnavailable {
+		err = json.Unmarshal([]byte(e.Message), &r)
+	}
+	return &r, err
+}
+
+// Refresh starts downloading and checking proxies. It returns ErrBusy if the server is already doing so.
+func (c *Client) Refresh(ctx context.Context) error {
+	resp, err := c.do(ctx, "GET", "/refresh", nil, nil)
+	if e, ok := err.(*APIError); ok && e.StatusCode == http.StatusConflict {
+		return ErrBusy
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Reload makes the server re-read its config file. It returns false if the settings will be applied when the
+// running download or check finishes.
+func (c *Client) Reload(ctx context.Context) (bool, error) {
+	resp, err := c.do(ctx, "POST", "/reload", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Applied bool `json:"applied"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Applied, err
+}
+
+// Events streams events of the given types, or all types if none are given, calling fn with each one
+// until ctx is done, the stream ends or fn returns an error.
+func (c *Client) Events(ctx context.Context, types []string, fn func(Event) error) error {
+	v := url.Values{}
+	for _, t := range types {
+		v.Add("types", t)
+	}
+	resp, err := c.do(ctx, "GET", "/events", v, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var data []byte
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		case line == "" && len(data) != 0:
+			var e Event
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			data = nil
+			if e.Type == "ping" {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
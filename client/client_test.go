@@ -0,0 +1,103 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get/2", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(APIKeyHeader) != "pxi_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid api key"}`)
+			return
+		}
+		if got := r.URL.Query().Encode(); got != "anon=&country=US&country=DE&max_latency=2s" {
+			t.Errorf("GetN query = %v", got)
+		}
+		fmt.Fprint(w, `[{"proxy": "http://1.1.1.1:80", "country": "US", "anonymous": true, "response_time": "1s"},
+			{"proxy": "http://2.2.2.2:80", "country": "DE", "anonymous": true}]`)
+	})
+	mux.HandleFunc("/find", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("proxy") == "http://1.1.1.1:80" {
+			fmt.Fprint(w, `{"proxy": "http://1.1.1.1:80", "last_status": "good"}`)
+			return
+		}
+		fmt.Fprint(w, `null`)
+	})
+	mux.HandleFunc("/proxies", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Encode(); got != "cursor=&limit=1&sort=-latency" {
+			t.Errorf("List query = %v", got)
+		}
+		w.Header().Set("X-Total-Count", "2")
+		w.Header().Set("X-Next-Cursor", "7")
+		fmt.Fprint(w, `[{"proxy": "http://1.1.1.1:80"}]`)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"anon": 1, "good": 2, "timeout": 3, "total": 6, "recently_checked": 5}`)
+	})
+	mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "busy")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := New(ts.URL+"/", "pxi_test")
+
+	proxies, err := c.GetN(ctx, 2, &Filter{Anon: true, Countries: []string{"US", "DE"}, MaxLatency: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[0].Country != "US" || *proxies[0].RespTime != "1s" {
+		t.Errorf("GetN = %+v", proxies)
+	}
+
+	_, err = New(ts.URL, "").GetN(ctx, 2, nil)
+	if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "invalid api key" {
+		t.Errorf("GetN without key error = %v; want 401 APIError", err)
+	}
+
+	if p, err := c.Find(ctx, "http://1.1.1.1:80"); err != nil || p.LastStatus != "good" {
+		t.Errorf("Find = %+v, %v", p, err)
+	}
+	if _, err := c.Find(ctx, "http://9.9.9.9:80"); err != ErrNotFound {
+		t.Errorf("Find missing proxy error = %v; want ErrNotFound", err)
+	}
+
+	res, err := c.List(ctx, &Filter{Sort: "-latency"}, Page{Limit: 1, UseCursor: true})
+	if err != nil || len(res.Proxies) != 1 || res.Total != 2 || res.NextCursor != "7" {
+		t.Errorf("List = %+v, %v", res, err)
+	}
+
+	if s, err := c.Stats(ctx); err != nil || *s != (TableStats{1, 2, 3, 6, 5}) {
+		t.Errorf("Stats = %+v, %v", s, err)
+	}
+
+	if err := c.Refresh(ctx); err != ErrBusy {
+		t.Errorf("Refresh error = %v; want ErrBusy", err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/proxi/internal"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// checkCmd represents the check command
+var (
+	checkFile string
+	checkJSON bool
+	checkCmd  = &cobra.Command{
+		Use:   "check [proxy...]",
+		Short: "Check proxies without adding them to the db.",
+		Long: `Check proxies against a judge the same way the server does, reporting status, anonymity and
+response time without adding them to the db. Exits with status 1 if no proxy passes.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 && checkFile == "" {
+				return errors.New("requires a proxy argument or --file")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			proxies := args
+			if checkFile != "" {
+				b, err := ioutil.ReadFile(checkFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				proxies = append(proxies, strings.Fields(string(b))...)
+			}
+			if internal.Workers < 1 {
+				internal.Workers = 1
+			}
+			results := internal.CheckProxies(proxies)
+			printCheckResults(results)
+			for _, r := range results {
+				if r.Status == "good" {
+					return
+				}
+			}
+			os.Exit(1)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.PersistentFlags().StringVarP(&checkFile, "file", "f", "", "File with one proxy per line.")
+	checkCmd.PersistentFlags().BoolVar(&checkJSON, "json", false, "Print results as json instead of a table.")
+	checkCmd.PersistentFlags().DurationVar(&internal.Timeout, "check-timeout", 30*time.Second, "Specify request time out for checking proxies.")
+	checkCmd.PersistentFlags().IntVarP(&internal.Workers, "workers", "w", 20, "Number of proxies to check at once.")
+	checkCmd.PersistentFlags().StringSliceVar(&internal.Judges, "judges", envList("PROXI_JUDGES"), "Extra judge urls to test along with the defaults. The fastest is used for checks.")
+	checkCmd.PersistentFlags().BoolVar(&internal.DebugJudges, "debug-judges", envBool("PROXI_DEBUG_JUDGES"), "Print judge test results and the judge chosen.")
+}
+
+func printCheckResults(results []*internal.CheckResult) {
+	if checkJSON {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"proxy", "status", "anonymous", "response_time", "error"})
+	table.SetAutoWrapText(false)
+	for _, r := range results {
+		table.Append([]string{r.Proxy, r.Status, strconv.FormatBool(r.Anonymous), r.RespTime, r.Error})
+	}
+	table.Render()
+}
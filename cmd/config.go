@@ -0,0 +1,334 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nicksherron/proxi/internal"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Setting sources, in order of precedence.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceConfig  = "config"
+	sourceDefault = "default"
+)
+
+var (
+	configFile string
+	// configWebhooks are the webhooks listed in the server section of the config file, if any.
+	configWebhooks []*internal.Webhook
+	// envVars are the environment variables that set a flag's default.
+	envVars = map[string]string{
+		"addr":                "PROXI_ADDRESS",
+		"url":                 "PROXI_ADDRESS",
+		"workers":             "PROXI_WORKERS",
+		"judges":              "PROXI_JUDGES",
+		"debug-judges":        "PROXI_DEBUG_JUDGES",
+		"dump":                "PROXI_DUMP",
+		"provider-debug":      "PROXI_PROVIDER_DEBUG",
+		"api-key":             "PROXI_API_KEY",
+		"log-level":           "PROXI_LOG_LEVEL",
+		"log-format":          "PROXI_LOG_FORMAT",
+		"maxmind-license-key": "PROXI_MAXMIND_LICENSE_KEY",
+	}
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Show the effective configuration.",
+		Long: `Settings are read from the config file, a yaml file at --config or PROXI_CONFIG,
+defaulting to config.yaml in the config dir. Top level keys apply to every command with a
+flag of that name and keys under a command name only apply to that command, eg
+
+  url: http://proxi.internal:4444
+  server:
+    workers: 200
+    check_timeout: 15s
+    judges: [http://judge.internal]
+    webhooks:
+      - url: https://alerts.example.com/proxi
+        good_below: 500
+
+Keys are flag names, with - or _. Flags take precedence over environment variables, which
+take precedence over the config file, which takes precedence over the defaults.`,
+	}
+	configShowCmd = &cobra.Command{
+		Use:   "show [command]",
+		Short: "Print the effective configuration of a command, server by default, and where each setting came from.",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := "server"
+			if len(args) == 1 {
+				name = args[0]
+			}
+			target, _, err := rootCmd.Find([]string{name})
+			if err != nil || target == rootCmd {
+				log.Fatalf("unknown command %q", name)
+			}
+			if err := target.ParseFlags(nil); err != nil {
+				log.Fatal(err)
+			}
+			sources, err := applyConfig(target)
+			if err != nil {
+				log.Fatalf("config %v: %v", configFile, err)
+			}
+			showConfig(target, sources)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", configPath(), "Yaml config file. See 'proxi config --help'.")
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if cmd == configShowCmd {
+			return
+		}
+		if _, err := applyConfig(cmd); err != nil {
+			log.Fatalf("config %v: %v", configFile, err)
+		}
+		if err := internal.ConfigureLogging(logLevel, logFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func configPath() string {
+	if os.Getenv("PROXI_CONFIG") != "" {
+		return os.Getenv("PROXI_CONFIG")
+	}
+	return filepath.Join(configHome(), "config.yaml")
+}
+
+// readConfig reads and validates configFile. A missing file is only an error if it was set explicitly.
+func readConfig() (map[string]interface{}, error) {
+	settings := make(map[string]interface{})
+	b, err := ioutil.ReadFile(configFile)
+	explicit := rootCmd.PersistentFlags().Changed("config") || os.Getenv("PROXI_CONFIG") != ""
+	if os.IsNotExist(err) && !explicit {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return nil, err
+	}
+	for key, v := range settings {
+		sub := subcommand(key)
+		if sub == nil {
+			if flagFor(rootCmd, key) == nil {
+				return nil, fmt.Errorf("unknown setting %q", key)
+			}
+			continue
+		}
+		section, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v: expected a map of settings", key)
+		}
+		for k := range section {
+			name := fmt.Sprint(k)
+			if flagFor(sub, name) == nil && !(sub == serverCmd && name == "webhooks") {
+				return nil, fmt.Errorf("%v: unknown setting %q", key, name)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// subcommand returns the top level command called name or nil.
+func subcommand(name string) *cobra.Command {
+	for _, c := range rootCmd.Commands() {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// flagFor returns the flag of cmd or any of its subcommands matching the setting key.
+func flagFor(cmd *cobra.Command, key string) *pflag.Flag {
+	name := strings.Replace(key, "_", "-", -1)
+	if f := cmd.Flags().Lookup(name); f != nil {
+		return f
+	}
+	if f := cmd.PersistentFlags().Lookup(name); f != nil {
+		return f
+	}
+	if f := cmd.InheritedFlags().Lookup(name); f != nil {
+		return f
+	}
+	for _, c := range cmd.Commands() {
+		if f := flagFor(c, key); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// applyConfig sets cmd's flags that weren't set on the command line or by an environment variable from the
+// config file, and returns where each flag's value came from.
+func applyConfig(cmd *cobra.Command) (map[string]string, error) {
+	top := cmd
+	for top.HasParent() && top.Parent() != rootCmd {
+		top = top.Parent()
+	}
+	sources, hooks, err := configure(cmd.Flags(), top)
+	if err != nil {
+		return nil, err
+	}
+	configWebhooks = hooks
+	return sources, nil
+}
+
+// configure sets the flags in fs that weren't set on the command line or by an environment variable from the
+// top level settings and the section of the top command. It returns where each flag's value came from and
+// the inline webhooks of the server section.
+func configure(fs *pflag.FlagSet, top *cobra.Command) (map[string]string, []*internal.Webhook, error) {
+	settings, err := readConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	var hooks []*internal.Webhook
+	sources := make(map[string]string)
+	fs.VisitAll(func(f *pflag.Flag) {
+		switch {
+		case f.Changed:
+			sources[f.Name] = sourceFlag
+		case envVars[f.Name] != "" && os.Getenv(envVars[f.Name]) != "":
+			sources[f.Name] = sourceEnv
+		default:
+			sources[f.Name] = sourceDefault
+		}
+	})
+
+	apply := func(prefix string, section map[string]interface{}) error {
+		for key, v := range section {
+			if prefix == "" && subcommand(key) != nil {
+				continue
+			}
+			if top == serverCmd && key == "webhooks" && prefix != "" {
+				if _, ok := v.([]interface{}); ok {
+					if sources["webhooks"] == sourceFlag {
+						continue
+					}
+					if hooks, err = parseWebhooks(v); err != nil {
+						return fmt.Errorf("%vwebhooks: %v", prefix, err)
+					}
+					sources["webhooks"] = sourceConfig
+					continue
+				}
+			}
+			f := fs.Lookup(strings.Replace(key, "_", "-", -1))
+			if f == nil || sources[f.Name] == sourceFlag || sources[f.Name] == sourceEnv {
+				continue
+			}
+			values := []interface{}{v}
+			if list, ok := v.([]interface{}); ok {
+				values = list
+			}
+			for _, value := range values {
+				if err := f.Value.Set(fmt.Sprint(value)); err != nil {
+					return fmt.Errorf("%v%v: %v", prefix, key, err)
+				}
+			}
+			sources[f.Name] = sourceConfig
+		}
+		return nil
+	}
+	if err := apply("", settings); err != nil {
+		return nil, nil, err
+	}
+	if section, ok := settings[top.Name()].(map[interface{}]interface{}); ok {
+		m := make(map[string]interface{})
+		for k, v := range section {
+			m[fmt.Sprint(k)] = v
+		}
+		if err := apply(top.Name()+".", m); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sources, hooks, nil
+}
+
+func parseWebhooks(v interface{}) ([]*internal.Webhook, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*internal.Webhook
+	if err := yaml.UnmarshalStrict(b, &hooks); err != nil {
+		return nil, err
+	}
+	if len(hooks) == 0 {
+		return nil, errors.New("expected a list of webhooks")
+	}
+	if err := internal.ValidateWebhooks(hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// showConfig prints cmd's settings as yaml with where each came from.
+func showConfig(cmd *cobra.Command, sources map[string]string) {
+	var names []string
+	inlineWebhooks := cmd == serverCmd && configWebhooks != nil && sources["webhooks"] == sourceConfig
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Name != "help" && f.Name != "config" && !(f.Name == "webhooks" && inlineWebhooks) {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	fmt.Printf("# config file: %v\n", configFile)
+	fmt.Printf("# precedence: flags, environment variables, config file, defaults\n")
+	fmt.Printf("%v:\n", cmd.Name())
+	for _, name := range names {
+		f := cmd.Flags().Lookup(name)
+		value := f.Value.String()
+		switch {
+		case (name == "api-key" || name == "maxmind-license-key") && value != "":
+			value = "<set>"
+		case f.Value.Type() == "string":
+			b, _ := yaml.Marshal(value)
+			value = strings.TrimSpace(string(b))
+		}
+		source := sources[name]
+		if source == sourceEnv {
+			source += " " + envVars[name]
+		}
+		fmt.Printf("  %v: %v  # %v\n", strings.Replace(name, "-", "_", -1), value, source)
+	}
+	if inlineWebhooks {
+		b, _ := yaml.Marshal(configWebhooks)
+		fmt.Printf("  webhooks:  # config\n")
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			fmt.Printf("  %v\n", line)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// eventsCmd represents the events command
+var (
+	eventTypes []string
+	eventsCmd  = &cobra.Command{
+		Use:   "events",
+		Short: "Stream pool changes and job progress from the server.",
+		Long: `Stream pool changes and job progress from the server's /events endpoint.
+
+Event types are proxy_good, proxy_bad, proxy_deleted, download_started, download_finished,
+check_started, check_progress and check_finished.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			printEvents(eventTypes)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(eventsCmd)
+	eventsCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	eventsCmd.PersistentFlags().StringSliceVarP(&eventTypes, "types", "t", nil, "Only stream these event types.")
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	"github.com/nicksherron/proxi/client"
+	"github.com/spf13/cobra"
+)
+
+// execCmd represents the exec command
+var (
+	execProxy   string
+	execRetries int
+	execRetryOn []int
+	execReport  bool
+	execCmd     = &cobra.Command{
+		Use:   "exec [flags] [--] command [args...]",
+		Short: "Run a command with proxy environment variables set to a proxy from the server.",
+		Long: `Run a command with HTTP_PROXY, HTTPS_PROXY and ALL_PROXY (and their lowercase forms) set to a
+proxy from the server, or to --proxy, eg a local gateway. With --retry-on the command is run again
+with another proxy when it exits with one of the given codes. Exits with the command's exit code.`,
+		Example: `  proxi exec --anon -c US -- curl -s https://example.com
+  proxi exec --retry-on 7,28,56 -- curl -sf https://example.com`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("requires a command to run")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			execProxied(args)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+	// flags after the command belong to it.
+	execCmd.Flags().SetInterspersed(false)
+	execCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	execCmd.PersistentFlags().BoolVar(&anon, "anon", false, "Only use anonymous proxies.")
+	execCmd.PersistentFlags().StringSliceVarP(&countries, "country", "c", nil, "Only use proxies in these countries. Format is 'US', 'CH' etc.")
+	execCmd.PersistentFlags().StringVar(&execProxy, "proxy", "", "Use this proxy instead of getting one from the server.")
+	execCmd.PersistentFlags().IntSliceVar(&execRetryOn, "retry-on", nil, "Exit codes of the command to retry with another proxy on.")
+	execCmd.PersistentFlags().IntVar(&execRetries, "retries", 2, "Number of other proxies to try with --retry-on.")
+	execCmd.PersistentFlags().BoolVar(&execReport, "report", false, "Report whether each proxy worked to the server, using --retry-on codes as failures. Needs a worker or admin api key.")
+}
+
+func execProxied(args []string) {
+	c := newClient()
+	ctx := context.Background()
+	proxies := []string{execProxy}
+	if execProxy == "" {
+		n := 1
+		if len(execRetryOn) != 0 {
+			n += execRetries
+		}
+		result, err := c.GetN(ctx, n, &client.Filter{Anon: anon, Countries: countries})
+		check(err)
+		if len(result) == 0 {
+			fmt.Fprintln(os.Stderr, "The server has no proxies matching the filters.")
+			os.Exit(1)
+		}
+		proxies = proxies[:0]
+		for _, p := range result {
+			proxies = append(proxies, p.Proxy)
+		}
+	}
+
+	// the child gets interrupts from the terminal itself, so wait for it to exit instead of dying first.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	for i, proxy := range proxies {
+		code := runWithProxy(proxy, args)
+		failed := false
+		for _, rc := range execRetryOn {
+			failed = failed || code == rc
+		}
+		if execReport && execProxy == "" {
+			if err := c.Report(ctx, proxy, !failed); err != nil {
+				fmt.Fprintf(os.Stderr, "reporting %v: %v\n", proxy, err)
+			}
+		}
+		if !failed || i == len(proxies)-1 {
+			os.Exit(code)
+		}
+		fmt.Fprintf(os.Stderr, "%v exited with %d using %v, retrying with another proxy\n", args[0], code, proxy)
+	}
+}
+
+// runWithProxy runs args with the proxy environment variables set to proxy and returns its exit code.
+func runWithProxy(proxy string, args []string) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy"} {
+		cmd.Env = append(cmd.Env, v+"="+proxy)
+	}
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicksherron/proxi/client"
+	"github.com/nicksherron/proxi/transport"
+	"github.com/spf13/cobra"
+)
+
+// fetchCmd represents the fetch command
+var (
+	fetchMethod  string
+	fetchHeaders []string
+	fetchData    string
+	fetchRetries int
+	fetchTimeout time.Duration
+	fetchReport  bool
+	fetchCmd     = &cobra.Command{
+		Use:     "fetch <url>",
+		Aliases: []string{"curl"},
+		Short:   "Fetch a url through a proxy from the server.",
+		Long: `Fetch a url through a proxy from the server, retrying with other proxies on failure.
+
+The proxy used, status and headers are printed to stderr and the body to stdout.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("requires a url argument")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			fetch(args[0])
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	fetchCmd.PersistentFlags().BoolVar(&anon, "anon", false, "Only use anonymous proxies.")
+	fetchCmd.PersistentFlags().StringSliceVarP(&countries, "country", "c", nil, "Only use proxies in these countries. Format is 'US', 'CH' etc.")
+	fetchCmd.PersistentFlags().StringVarP(&fetchMethod, "request", "X", "GET", "Request method.")
+	fetchCmd.PersistentFlags().StringArrayVarP(&fetchHeaders, "header", "H", nil, "Request header, eg 'Accept: text/html'. Can be repeated.")
+	fetchCmd.PersistentFlags().StringVarP(&fetchData, "data", "d", "", "Request body.")
+	fetchCmd.PersistentFlags().IntVar(&fetchRetries, "retries", 3, "Number of other proxies to try after a failure.")
+	fetchCmd.PersistentFlags().DurationVar(&fetchTimeout, "timeout", 30*time.Second, "Timeout for each attempt.")
+	fetchCmd.PersistentFlags().BoolVar(&fetchReport, "report", false, "Report whether each proxy worked to the server.")
+}
+
+// fetchSource gets proxies from the server. Outcomes are reported by fetch itself so they're sent before exiting.
+type fetchSource struct {
+	*transport.ClientSource
+}
+
+func (fetchSource) Report(ctx context.Context, proxy string, ok bool) error {
+	return nil
+}
+
+func fetch(target string) {
+	c := newClient()
+	src := fetchSource{&transport.ClientSource{Client: c, Filter: &client.Filter{Anon: anon, Countries: countries}}}
+	rt := transport.NewRotator(src, transport.PerRequest)
+	rt.Retries = fetchRetries
+	rt.PoolSize = fetchRetries + 1
+	rt.Timeout = fetchTimeout
+
+	type attempt struct {
+		proxy string
+		ok    bool
+	}
+	var attempts []attempt
+	rt.Attempted = func(proxy string, ok bool) {
+		attempts = append(attempts, attempt{proxy, ok})
+		if !ok {
+			fmt.Fprintf(os.Stderr, "proxy %v failed, retrying\n", proxy)
+		}
+	}
+
+	var body io.Reader
+	if fetchData != "" {
+		body = strings.NewReader(fetchData)
+	}
+	req, err := http.NewRequest(fetchMethod, target, body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("User-Agent", transport.UserAgent)
+	for _, h := range fetchHeaders {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid header %q, expected 'Name: value'", h)
+		}
+		req.Header.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if fetchReport {
+		for _, a := range attempts {
+			if rerr := c.Report(context.Background(), a.proxy, a.ok); rerr != nil {
+				fmt.Fprintf(os.Stderr, "reporting %v: %v\n", a.proxy, rerr)
+			}
+		}
+	}
+	if err != nil {
+		switch uerr := errors.Unwrap(err); {
+		case uerr == transport.ErrNoProxies:
+			fmt.Fprintln(os.Stderr, "The server has no proxies matching the filters.")
+			os.Exit(1)
+		case len(attempts) == 0:
+			// the error came from getting proxies from the server.
+			check(uerr)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	fmt.Fprintf(os.Stderr, "proxy: %v\n", attempts[len(attempts)-1].proxy)
+	fmt.Fprintf(os.Stderr, "%v %v\n", resp.Proto, resp.Status)
+	resp.Header.Write(os.Stderr)
+	fmt.Fprintln(os.Stderr)
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+}
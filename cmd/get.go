@@ -18,19 +18,40 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 // getCmd represents the stats command
 var (
-	numProxies int
-	anon       bool
-	country    string
-	getAll     bool
-	getCmd     = &cobra.Command{
+	numProxies    int
+	anon          bool
+	countries     []string
+	exitCountries []string
+	getAll        bool
+	statuses      []string
+	sources       []string
+	protocols     []string
+	regions       []string
+	asns          []uint
+	networkTypes  []string
+	cities        []string
+	subdivisions  []string
+	withBlocked   bool
+	minSuccess    uint
+	checkedSince  string
+	maxLatency    time.Duration
+	sortBy        string
+	offset        int
+	cursor        string
+	getCmd        = &cobra.Command{
 		Use:   "get",
 		Short: "Return one or more proxies from db that passed checks.",
+		Long: `Return one or more proxies from db that passed checks.
+
+Using --sort, --offset or --cursor lists proxies in order from the /proxies endpoint
+instead of returning a random selection.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Flags().Parse(args)
 			getProxy()
@@ -43,7 +64,23 @@ func init() {
 	getCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
 	getCmd.PersistentFlags().IntVarP(&numProxies, "num", "n", 1, "Number of proxies to return.")
 	getCmd.PersistentFlags().BoolVar(&anon, "anon", false, "Only return anonymous proxies.")
-	getCmd.PersistentFlags().StringVarP(&country, "country", "c", "", "Filter by country. Format is 'US', 'CH' etc.")
+	getCmd.PersistentFlags().StringSliceVarP(&countries, "country", "c", nil, "Filter by country. Format is 'US', 'CH' etc. Can be repeated or comma separated.")
+	getCmd.PersistentFlags().StringSliceVar(&exitCountries, "exit-country", nil, "Filter by the country of the ip the proxy's requests come from, which can differ from --country.")
 	getCmd.PersistentFlags().BoolVar(&getAll, "all", false, "Return all proxies ignoring filters or status. Warning! may produce lots of results.")
+	getCmd.PersistentFlags().StringSliceVar(&statuses, "status", nil, "Filter by last check status (good, fail, timeout). Defaults to good.")
+	getCmd.PersistentFlags().StringSliceVar(&sources, "source", nil, "Filter by the provider the proxy was found on.")
+	getCmd.PersistentFlags().StringSliceVar(&protocols, "protocol", nil, "Filter by proxy protocol, eg http.")
+	getCmd.PersistentFlags().StringSliceVar(&regions, "region", nil, "Only return proxies a worker in one of these regions last found good.")
+	getCmd.PersistentFlags().UintSliceVar(&asns, "asn", nil, "Filter by the ASN of the proxy's ip, eg 7922.")
+	getCmd.PersistentFlags().StringSliceVar(&networkTypes, "type", nil, "Filter by network type of the proxy's ip (hosting, residential, mobile).")
+	getCmd.PersistentFlags().StringSliceVar(&cities, "city", nil, "Filter by the city of the proxy's ip.")
+	getCmd.PersistentFlags().StringSliceVar(&subdivisions, "subdivision", nil, "Filter by the state or province of the proxy's ip.")
+	getCmd.PersistentFlags().BoolVar(&withBlocked, "include-blocked", false, "Include proxies on a blocklist or the server's deny list.")
+	getCmd.PersistentFlags().UintVar(&minSuccess, "min-success", 0, "Only return proxies with at least this many successful checks.")
+	getCmd.PersistentFlags().StringVar(&checkedSince, "checked-since", "", "Only return proxies checked since a RFC3339 time or a duration ago, eg 1h.")
+	getCmd.PersistentFlags().DurationVar(&maxLatency, "max-latency", 0, "Only return proxies whose last response time was at most this long.")
+	getCmd.PersistentFlags().StringVar(&sortBy, "sort", "", "Sort field, prefix with '-' for descending. eg -success_count, latency, checked_at.")
+	getCmd.PersistentFlags().IntVar(&offset, "offset", 0, "Number of proxies to skip when listing.")
+	getCmd.PersistentFlags().StringVar(&cursor, "cursor", "", "Cursor returned in X-Next-Cursor to continue listing from.")
 
 }
@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	healthLive    bool
+	healthTimeout time.Duration
+	healthCmd     = &cobra.Command{
+		Use:   "health",
+		Short: "Check whether the server is ready to serve proxies.",
+		Long: `Check the server's /readyz endpoint, which needs a reachable db, a resolved judge on the leader and
+at least --ready-min-good good proxies, and print the details. With --live only check the server is up
+with /healthz. Exits with status 0 if the server is ready, 1 if it isn't and 2 if it can't be reached.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+			defer cancel()
+			c := newClient()
+			if healthLive {
+				if err := c.Live(ctx); err != nil {
+					fmt.Fprintf(os.Stderr, "Request failed for %v: %v\n", address, err)
+					os.Exit(2)
+				}
+				fmt.Println("ok")
+				return
+			}
+			r, err := c.Ready(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Request failed for %v: %v\n", address, err)
+				os.Exit(2)
+			}
+			printJSON(r)
+			if !r.Ready {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(healthCmd)
+	healthCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	healthCmd.PersistentFlags().BoolVar(&healthLive, "live", false, "Only check the server is up.")
+	healthCmd.PersistentFlags().DurationVar(&healthTimeout, "timeout", 5*time.Second, "Give up on the server after this long.")
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// importCmd represents the import command
+var (
+	importFile   string
+	importSource string
+	importCmd    = &cobra.Command{
+		Use:   "import [proxy...]",
+		Short: "Import proxies into the db. They are checked with the next check cycle.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 && importFile == "" {
+				return errors.New("requires a proxy argument or --file")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			proxies := args
+			if importFile != "" {
+				b, err := ioutil.ReadFile(importFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				proxies = append(proxies, strings.Fields(string(b))...)
+			}
+			importProxies(proxies, importSource)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	importCmd.PersistentFlags().StringVarP(&importFile, "file", "f", "", "File with one proxy per line.")
+	importCmd.PersistentFlags().StringVar(&importSource, "source", "", "Source to record for the proxies. Defaults to import.")
+}
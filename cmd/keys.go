@@ -0,0 +1,109 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/nicksherron/proxi/internal"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var (
+	keyName       string
+	keyRole       string
+	keyRateLimit  float64
+	keyDailyQuota int64
+	keysCmd       = &cobra.Command{
+		Use:   "keys",
+		Short: "Manage api keys. Operates on the db directly, so run it where the server's db is reachable.",
+	}
+	keysCreateCmd = &cobra.Command{
+		Use:   "create",
+		Short: "Create an api key and print it. The key can't be shown again.",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.DbInit()
+			k, key, err := internal.CreateAPIKey(keyName, keyRole, keyRateLimit, keyDailyQuota)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Created %v key %v (id %v)\n", k.Role, k.Prefix, k.ID)
+			fmt.Println(key)
+		},
+	}
+	keysListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List api keys.",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.DbInit()
+			keys, err := internal.ListAPIKeys()
+			if err != nil {
+				log.Fatal(err)
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"id", "prefix", "name", "role", "rate_limit", "daily_quota", "created_at", "revoked_at"})
+			for _, k := range keys {
+				revoked := ""
+				if k.RevokedAt != nil {
+					revoked = k.RevokedAt.Format("2006-01-02 15:04:05")
+				}
+				table.Append([]string{strconv.Itoa(int(k.ID)), k.Prefix, k.Name, k.Role,
+					strconv.FormatFloat(k.RateLimit, 'f', -1, 64), strconv.FormatInt(k.DailyQuota, 10),
+					k.CreatedAt.Format("2006-01-02 15:04:05"), revoked})
+			}
+			table.Render()
+		},
+	}
+	keysRevokeCmd = &cobra.Command{
+		Use:   "revoke <id|prefix>",
+		Short: "Revoke an api key by id or prefix.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("requires a key id or prefix argument")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.DbInit()
+			n, err := internal.RevokeAPIKey(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			if n == 0 {
+				fmt.Printf("No active key matching %v\n", args[0])
+				os.Exit(1)
+			}
+			fmt.Printf("Revoked %v\n", args[0])
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+	keysCmd.PersistentFlags().StringVar(&internal.DbPath, "db", dbPath(), "Sqlite3 backend storage file location.")
+	keysCreateCmd.Flags().StringVar(&keyName, "name", "", "Name to identify the key.")
+	keysCreateCmd.Flags().StringVar(&keyRole, "role", internal.RoleRead, "Key role, read, worker or admin. Read keys can only query proxies and stats, worker keys can also check proxies for the server.")
+	keysCreateCmd.Flags().Float64Var(&keyRateLimit, "rate-limit", 0, "Requests per second allowed to the /get routes. 0 uses the server's --rate-limit.")
+	keysCreateCmd.Flags().Int64Var(&keyDailyQuota, "daily-quota", 0, "Proxies handed out per day. 0 uses the server's --daily-quota.")
+}
@@ -17,139 +17,204 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"time"
 
 	"github.com/TylerBrock/colorjson"
 	"github.com/fatih/color"
+	"github.com/nicksherron/proxi/client"
+	"github.com/nicksherron/proxi/internal"
 )
 
 var (
 	address string
+	apiKey  string
 )
 
-func get(u string) string {
-	resp, err := http.Get(u)
-	if err != nil {
-		fmt.Printf("Request failed for %v are you sure the server is running?\n", u)
-		os.Exit(1)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+// newClient returns a client for address using the api key from --api-key or PROXI_API_KEY.
+func newClient() *client.Client {
+	key := apiKey
+	if key == "" {
+		key = os.Getenv("PROXI_API_KEY")
 	}
-	return string(body)
+	return client.New(address, key)
 }
 
-func post(u string, data url.Values) string {
-	resp, err := http.PostForm(u, data)
-	if err != nil {
-		fmt.Printf("Request failed for %v are you sure the server is running?\n", u)
-		os.Exit(1)
+// check exits with a helpful message if err isn't nil.
+func check(err error) {
+	if err == nil {
+		return
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	apiErr, ok := err.(*client.APIError)
+	switch {
+	case ok && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden):
+		fmt.Fprintf(os.Stderr, "Request failed for %v: %v\nSet an api key with --api-key or PROXI_API_KEY.\n", address, err)
+	case ok:
+		fmt.Fprintf(os.Stderr, "Request failed for %v: %v\n", address, err)
+	default:
+		fmt.Printf("Request failed for %v are you sure the server is running?\n", address)
+	}
+	os.Exit(1)
+}
+
+// printJSON prints v as indented, colored json.
+func printJSON(v interface{}) {
+	b, err := json.Marshal(v)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return string(body)
+	var obj interface{}
+	json.Unmarshal(b, &obj)
+	f := colorjson.NewFormatter()
+	f.Indent = 2
+	s, _ := f.Marshal(obj)
+	fmt.Println(string(s))
 }
 
 func stats() {
-	var stat map[string]interface{}
-	u := fmt.Sprintf("%v/stats", address)
+	c := newClient()
+	ctx := context.Background()
 	if watch == 0 {
-		json.Unmarshal([]byte(get(u)), &stat)
-		f := colorjson.NewFormatter()
-		f.Indent = 2
-		s, _ := f.Marshal(stat)
-		fmt.Println(string(s))
-	} else {
+		stat, err := c.Stats(ctx)
+		check(err)
+		printJSON(stat)
+		return
+	}
+
+	interval := time.Duration(watch) * time.Second
+	printStats := func(msg string) {
+		stat, err := c.Stats(ctx)
+		check(err)
+		fmt.Printf("\033[5;1H")
+		fmt.Printf("%v\n\n", msg)
+		printJSON(stat)
+	}
+
+	// refresh on pool events instead of polling, at most once per interval except when a job finishes.
+	msg := fmt.Sprintf("updating on changes, at most every %d seconds", watch)
+	printStats(msg)
+	last := time.Now()
+	err := c.Events(ctx, nil, func(e client.Event) error {
+		finished := e.Type == internal.EventCheckFinished || e.Type == internal.EventDownloadFinished
+		if !finished && time.Since(last) < interval {
+			return nil
+		}
+		last = time.Now()
+		printStats(msg)
+		return nil
+	})
+	if err != nil {
+		// servers without /events
 		for {
-			fmt.Printf("\033[5;1H")
-			fmt.Printf("updating every %d seconds\n\n", watch)
-			json.Unmarshal([]byte(get(u)), &stat)
-			f := colorjson.NewFormatter()
-			f.Indent = 2
-			s, _ := f.Marshal(stat)
-			fmt.Println(string(s))
-			time.Sleep(time.Duration(watch) * time.Second)
+			printStats(fmt.Sprintf("updating every %d seconds", watch))
+			time.Sleep(interval)
 		}
 	}
 }
 
-func getProxy() {
+func printEvents(types []string) {
+	err := newClient().Events(context.Background(), types, func(e client.Event) error {
+		printJSON(e)
+		return nil
+	})
+	check(err)
+}
 
-	var (
-		proxies []interface{}
-		proxy   map[string]interface{}
-	)
+func getProxy() {
+	c := newClient()
+	ctx := context.Background()
 
 	if getAll {
-		u := fmt.Sprintf("%v/getall", address)
-		json.Unmarshal([]byte(get(u)), &proxies)
-		f := colorjson.NewFormatter()
-		f.Indent = 2
-		s, _ := f.Marshal(proxies)
-		fmt.Println(string(s))
+		proxies, err := c.GetAll(ctx)
+		check(err)
+		printJSON(proxies)
 		return
 	}
-	v := url.Values{}
-	if anon {
-		v.Add("anon", "")
+	f := &client.Filter{
+		Anon:           anon,
+		Countries:      countries,
+		ExitCountries:  exitCountries,
+		Status:         statuses,
+		Sources:        sources,
+		Protocols:      protocols,
+		Regions:        regions,
+		ASNs:           asns,
+		Types:          networkTypes,
+		Cities:         cities,
+		Subdivisions:   subdivisions,
+		IncludeBlocked: withBlocked,
+		MinSuccess:     minSuccess,
+		MaxLatency:     maxLatency,
+		Sort:           sortBy,
 	}
-	if country != "" {
-		v.Add("country", country)
+	if checkedSince != "" {
+		d, err := time.ParseDuration(checkedSince)
+		if err != nil {
+			t, terr := time.Parse(time.RFC3339, checkedSince)
+			if terr != nil {
+				log.Fatalf("invalid --checked-since %q, must be a duration or RFC3339 time", checkedSince)
+			}
+			d = time.Since(t)
+		}
+		f.CheckedSince = d
 	}
 
-	if numProxies == 1 {
-		u := fmt.Sprintf("%v/get?%v", address, v.Encode())
-		json.Unmarshal([]byte(get(u)), &proxy)
-		f := colorjson.NewFormatter()
-		f.Indent = 2
-		s, _ := f.Marshal(proxy)
-		fmt.Println(string(s))
+	if sortBy != "" || offset > 0 || cursor != "" {
+		res, err := c.List(ctx, f, client.Page{Limit: numProxies, Offset: offset, UseCursor: cursor != "", Cursor: cursor})
+		check(err)
+		printJSON(res.Proxies)
+		fmt.Fprintf(os.Stderr, "total: %v", res.Total)
+		if res.NextCursor != "" {
+			fmt.Fprintf(os.Stderr, "\tnext cursor: %v", res.NextCursor)
+		}
+		fmt.Fprintln(os.Stderr)
 		return
 	}
-	u := fmt.Sprintf("%v/get/%v?%v", address, numProxies, v.Encode())
-	json.Unmarshal([]byte(get(u)), &proxies)
-	f := colorjson.NewFormatter()
-	f.Indent = 2
-	s, _ := f.Marshal(proxies)
-	fmt.Println(string(s))
 
+	if numProxies == 1 {
+		proxy, err := c.Get(ctx, f)
+		check(err)
+		printJSON(proxy)
+		return
+	}
+	proxies, err := c.GetN(ctx, numProxies, f)
+	check(err)
+	printJSON(proxies)
 }
 
 func findProxy(proxy string) {
-	var body map[string]interface{}
-
-	u := fmt.Sprintf("%v/find", address)
-	v := url.Values{}
-	v.Add("proxy", proxy)
-	json.Unmarshal([]byte(post(u, v)), &body)
-	f := colorjson.NewFormatter()
-	f.Indent = 2
-	s, _ := f.Marshal(body)
-	fmt.Println(string(s))
+	p, err := newClient().Find(context.Background(), proxy)
+	if err == client.ErrNotFound {
+		printJSON(nil)
+		return
+	}
+	check(err)
+	printJSON(p)
 }
 
 func deleteProxy(proxy string) {
-
-	u := fmt.Sprintf("%v/delete", address)
-	v := url.Values{}
-	v.Add("proxy", proxy)
-	fmt.Println(post(u, v))
-
+	n, err := newClient().Delete(context.Background(), proxy)
+	check(err)
+	printJSON(map[string]int64{"deleted": n})
 }
 
 func getRefresh() {
-	u := fmt.Sprintf("%v/refresh", address)
-	color.HiGreen(get(u))
+	err := newClient().Refresh(context.Background())
+	if err == client.ErrBusy {
+		color.HiGreen("busy")
+		return
+	}
+	check(err)
+	color.HiGreen("ok")
+}
+
+func importProxies(proxies []string, source string) {
+	n, err := newClient().Import(context.Background(), proxies, source)
+	check(err)
+	printJSON(map[string]int{"imported": n})
 }
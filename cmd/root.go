@@ -25,7 +25,9 @@ import (
 )
 
 var (
-	rootCmd = &cobra.Command{
+	logLevel  string
+	logFormat string
+	rootCmd   = &cobra.Command{
 		Use: "proxi",
 	}
 )
@@ -56,6 +58,12 @@ func dataHome() string {
 	return ch
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", "", "Api key sent to the server. Defaults to PROXI_API_KEY.")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", envString("PROXI_LOG_LEVEL", "info"), "Minimum level logged: debug, info, warn or error.")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", envString("PROXI_LOG_FORMAT", "text"), "Log format: text (logfmt) or json.")
+}
+
 // Execute executes the root command.
 func Execute() error {
 	return rootCmd.Execute()
@@ -16,7 +16,10 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -24,72 +27,221 @@ import (
 	"runtime/pprof"
 	"runtime/trace"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/nicksherron/proxi/internal"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
 	updateFreq        int
+	serverSettings    internal.Settings
+	reloadMu          sync.Mutex
 	downloadCheckInit bool
 	checkInit         bool
 	traceProfile      string
 	cpuProfile        string
 	memProfile        string
 	pingDB            bool
+	shutdownTimeout   time.Duration
 	serverCmd         = &cobra.Command{
 		Use:   "server",
 		Short: "Download then check proxies and start rest api server for querying results.",
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Flags().Parse(args)
+			if err := validateServer(); err != nil {
+				log.Fatalf("invalid config: %v", err)
+			}
+			internal.ApplySettings(serverSettings)
+			if internal.MaxmindLicenseKey == "" {
+				internal.MaxmindLicenseKey = os.Getenv("PROXI_MAXMIND_LICENSE_KEY")
+			}
 			internal.DbInit()
 			oldLimit, newLimit := internal.IncrFdLimit()
 			if newLimit != 0 {
 				log.Printf("Increased maximum number of open files to %v (it was originally set to %v).",
 					newLimit, oldLimit)
 			}
+			var err error
 			if pingDB {
 				internal.DbPing()
 				return
 			}
+			if configWebhooks != nil && !cmd.Flags().Changed("webhooks") {
+				err = internal.SetWebhooks(configWebhooks)
+			} else {
+				err = internal.LoadWebhooks()
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			stopProfiles := func() {}
 			if cpuProfile != "" || memProfile != "" || traceProfile != "" {
-				profileInit()
+				stopProfiles = profileInit()
 			}
 			internal.StartupMessage()
-			go schedule()
+			go reloadOnHangup()
+			go shutdownOnSignal()
+			go internal.Elect()
+			go internal.Schedule()
+			if internal.Continuous {
+				go internal.CheckContinuously()
+			}
 			if downloadCheckInit {
 				time.Sleep(10 * time.Millisecond)
-				go internal.DownloadInit()
+				go func() {
+					internal.DownloadInit(internal.WaitLeader())
+				}()
 			} else if checkInit {
 				time.Sleep(10 * time.Millisecond)
-				go internal.CheckInit()
+				go func() {
+					internal.CheckInit(internal.WaitLeader())
+				}()
 			}
 			internal.API()
+			stopProfiles()
 		},
 	}
 )
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
+	internal.Reload = reloadServer
 	serverCmd.PersistentFlags().StringVar(&traceProfile, "trace", "", "Write trace profile to file.")
 	serverCmd.PersistentFlags().StringVar(&cpuProfile, "cpu", "", "Write cpu profile to file.")
 	serverCmd.PersistentFlags().StringVar(&memProfile, "mem", "", "Write memory profile to file.")
 	serverCmd.PersistentFlags().BoolVar(&downloadCheckInit, "init", false, "Initialize proxy download and check process after server start.")
 	serverCmd.PersistentFlags().BoolVar(&checkInit, "check", false, "Initialize proxy  check process after server start.")
 	serverCmd.PersistentFlags().StringVarP(&internal.Addr, "addr", "a", listenAddr(), "Ip and port to listen and serve on.")
-	serverCmd.PersistentFlags().StringVar(&internal.MaxmindFilePath, "maxmind-file", maxmindPath(), "Maxmind country db file. Downloads if default doesn't exist.")
+	serverCmd.PersistentFlags().StringVar(&internal.MaxmindFilePath, "maxmind-file", maxmindPath(), "Maxmind country db file. Downloads if it doesn't exist.")
+	serverCmd.PersistentFlags().StringVar(&internal.MaxmindURL, "maxmind-url", internal.MaxmindURL, "Url to download the maxmind country db from without a license key, a mmdb file or a tar.gz of one.")
+	serverCmd.PersistentFlags().StringVar(&internal.MaxmindLicenseKey, "maxmind-license-key", "", "MaxMind license key to download the GeoLite2 country, asn and city dbs from MaxMind. Defaults to PROXI_MAXMIND_LICENSE_KEY.")
+	serverCmd.PersistentFlags().StringVar(&internal.MaxmindASNFilePath, "maxmind-asn-file", filepath.Join(dataHome(), "GeoLite2-ASN.mmdb"), "Maxmind GeoLite2-ASN db file. Used to record the ASN and network type of proxies if it exists or --maxmind-license-key is set.")
+	serverCmd.PersistentFlags().StringVar(&internal.MaxmindCityFilePath, "maxmind-city-file", filepath.Join(dataHome(), "GeoLite2-City.mmdb"), "Maxmind GeoLite2-City db file. Used to record the city of proxies if it exists or --maxmind-license-key is set.")
+	serverCmd.PersistentFlags().StringVar(&internal.HostingASNFile, "hosting-asn-file", filepath.Join(configHome(), "hosting-asns.txt"), "File of cloud and datacenter ASNs, one per line, to classify proxies as hosting. Ignored if it doesn't exist.")
+	serverCmd.PersistentFlags().StringVar(&internal.MobileASNFile, "mobile-asn-file", filepath.Join(configHome(), "mobile-asns.txt"), "File of cellular carrier ASNs, one per line, to classify proxies as mobile. Ignored if it doesn't exist.")
+	serverCmd.PersistentFlags().StringVar(&internal.ResidentialASNFile, "residential-asn-file", filepath.Join(configHome(), "residential-asns.txt"), "File of home isp ASNs, one per line, to classify proxies as residential. Ignored if it doesn't exist.")
+	serverCmd.PersistentFlags().UintSliceVar(&internal.HostingASNs, "hosting-asns", nil, "ASNs to classify as hosting in addition to --hosting-asn-file.")
+	serverCmd.PersistentFlags().UintSliceVar(&internal.MobileASNs, "mobile-asns", nil, "ASNs to classify as mobile in addition to --mobile-asn-file.")
+	serverCmd.PersistentFlags().UintSliceVar(&internal.ResidentialASNs, "residential-asns", nil, "ASNs to classify as residential in addition to --residential-asn-file.")
 	serverCmd.PersistentFlags().StringVar(&internal.DbPath, "db", dbPath(), "Sqlite3 backend storage file location.")
-	serverCmd.PersistentFlags().StringVar(&internal.LogFile, "log", logPath(), "Set filepath for HTTP log.")
+	serverCmd.PersistentFlags().StringVar(&internal.LogFile, "log", logPath(), "Set filepath for HTTP log, or - for stdout.")
 	serverCmd.PersistentFlags().IntVar(&internal.FileLimitMax, "ulimit", 2048, "Number of allowed file handles per process.")
-	serverCmd.PersistentFlags().IntVar(&updateFreq, "interval", 12, "Wait interval in hours before (re)checking proxies and downloading new ones.")
-	serverCmd.PersistentFlags().DurationVar(&internal.Timeout, "check-timeout", 30*time.Second, "Specify request time out for checking proxies.")
-	serverCmd.PersistentFlags().DurationVar(&internal.DownloadTimeout, "download-timeout", 60*time.Second, "Specify timeout out for downloading proxies.")
-	serverCmd.PersistentFlags().IntVarP(&internal.Workers, "workers", "w", workerN(), "Number of (goroutines) concurrent requests to make for checking proxies.")
+	reloadableFlags(serverCmd.PersistentFlags(), &serverSettings, &updateFreq)
+	serverCmd.PersistentFlags().BoolVar(&internal.Continuous, "continuous", false, "Check proxies as they come due, good ones every --recheck-min and failing ones with backoff, instead of on the check schedules.")
 	serverCmd.PersistentFlags().BoolVar(&pingDB, "ping", false, "Ping db and exit.")
+	serverCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait on SIGTERM for requests and the running job to finish before exiting.")
+	serverCmd.PersistentFlags().Int64Var(&internal.ReadyMinGood, "ready-min-good", 0, "Good proxies needed for /readyz to report the server ready.")
+	serverCmd.PersistentFlags().BoolVar(&internal.AuthEnabled, "auth", false, "Require an api key for api requests. Create keys with 'proxi keys create'.")
+	serverCmd.PersistentFlags().Float64Var(&internal.RateLimit, "rate-limit", 0, "Requests per second allowed to the /get routes per api key or ip. 0 disables rate limiting.")
+	serverCmd.PersistentFlags().IntVar(&internal.RateBurst, "rate-burst", 0, "Number of /get requests allowed at once before --rate-limit applies. Defaults to the rate limit.")
+	serverCmd.PersistentFlags().StringVar(&internal.WebhooksFile, "webhooks", webhooksPath(), "Json file with webhooks to send pool alerts to. Ignored if it doesn't exist.")
+	serverCmd.PersistentFlags().StringSliceVar(&internal.TrustedProxies, "trusted-proxies", nil, "CIDRs or ips of reverse proxies whose X-Forwarded-For and X-Real-Ip headers are trusted for client ips.")
+	serverCmd.PersistentFlags().Int64Var(&internal.DailyQuota, "daily-quota", 0, "Proxies handed out per api key or ip per day (UTC). 0 disables the quota.")
 	serverCmd.PersistentFlags().BoolVarP(&internal.Progress, "progress", "p", isTerminal(os.Stderr), "Show proxy test progress bar.")
+	serverCmd.PersistentFlags().BoolVar(&internal.DebugJudges, "debug-judges", envBool("PROXI_DEBUG_JUDGES"), "Print judge test results and the judge chosen.")
+	serverCmd.PersistentFlags().BoolVar(&internal.Dump, "dump", envBool("PROXI_DUMP"), "Write downloaded proxies to a temp file.")
+	serverCmd.PersistentFlags().BoolVar(&internal.ProviderDebug, "provider-debug", envBool("PROXI_PROVIDER_DEBUG"), "Print the time taken and proxies found for each provider.")
+}
+
+// reloadableFlags adds the server flags that are re-read from the config file on reload to fs.
+func reloadableFlags(fs *pflag.FlagSet, s *internal.Settings, hours *int) {
+	fs.IntVar(hours, "interval", 12, "Wait interval in hours between runs of jobs without a schedule.")
+	fs.DurationVar(&s.RecheckMin, "recheck-min", 30*time.Minute, "Wait before re-checking a good proxy in --continuous mode, and the first backoff of failing ones.")
+	fs.DurationVar(&s.RecheckMax, "recheck-max", 24*time.Hour, "Longest backoff before re-checking a failing proxy in --continuous mode.")
+	fs.StringVar(&s.DownloadSchedule, "download-schedule", "", "Cron expression for downloading proxies and checking new ones, eg '0 */6 * * *'. Defaults to every --interval hours.")
+	fs.StringVar(&s.CheckGoodSchedule, "check-good-schedule", "", "Cron expression for re-checking good proxies. Defaults to every --interval hours.")
+	fs.StringVar(&s.CheckBadSchedule, "check-bad-schedule", "", "Cron expression for re-checking failed and timed out proxies. Defaults to every --interval hours.")
+	fs.StringVar(&s.MaxmindSchedule, "maxmind-schedule", "@weekly", "Cron expression for updating the maxmind dbs and locating proxies again if they changed.")
+	fs.StringVar(&s.BlocklistSchedule, "blocklist-schedule", "@hourly", "Cron expression for reloading the blocklists and tagging the proxies on them.")
+	fs.StringSliceVar(&s.Blocklists, "blocklists", nil, "Files of CIDRs or ips, eg Spamhaus DROP or FireHOL netsets. Proxies whose ip or exit ip is listed are left out of /get.")
+	fs.StringSliceVar(&s.Allow, "allow", nil, "CIDRs, ips or ASNs like AS64500 whose proxies are never blocked.")
+	fs.StringSliceVar(&s.Deny, "deny", nil, "CIDRs, ips or ASNs like AS64500 whose proxies are always blocked.")
+	fs.DurationVar(&s.Timeout, "check-timeout", 30*time.Second, "Specify request time out for checking proxies.")
+	fs.DurationVar(&s.DownloadTimeout, "download-timeout", 60*time.Second, "Specify timeout out for downloading proxies.")
+	fs.IntVarP(&s.Workers, "workers", "w", workerN(), "Number of (goroutines) concurrent requests to make for checking proxies.")
+	fs.StringSliceVar(&s.Judges, "judges", envList("PROXI_JUDGES"), "Extra judge urls to test along with the defaults. The fastest is used for checks.")
+	fs.StringSliceVar(&s.DisabledProviders, "disable-providers", nil, "Providers to skip when downloading proxies, eg us-proxy.org.")
+}
+
+// reloadServer re-reads the config file and applies the reloadable settings and webhooks. Flags set on the
+// command line keep their values. It returns true if the settings were applied now rather than after the
+// running download or check.
+func reloadServer() (bool, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	var (
+		s     internal.Settings
+		hours int
+		err   error
+	)
+	fs := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	reloadableFlags(fs, &s, &hours)
+	fs.VisitAll(func(f *pflag.Flag) {
+		if sf := serverCmd.Flags().Lookup(f.Name); err == nil && sf != nil && sf.Changed {
+			// slice values print as [a,b].
+			err = fs.Set(f.Name, strings.Trim(sf.Value.String(), "[]"))
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	_, hooks, err := configure(fs, serverCmd)
+	if err != nil {
+		return false, fmt.Errorf("config %v: %v", configFile, err)
+	}
+	s.Interval = time.Duration(hours) * time.Hour
+	if err := s.Validate(); err != nil {
+		return false, fmt.Errorf("invalid config: %v", err)
+	}
+	if hooks != nil && !serverCmd.Flags().Changed("webhooks") {
+		err = internal.SetWebhooks(hooks)
+	} else {
+		err = internal.LoadWebhooks()
+	}
+	if err != nil {
+		return false, err
+	}
+	configWebhooks = hooks
+	return internal.ApplySettings(s), nil
+}
+
+// shutdownOnSignal shuts the server down gracefully on SIGINT or SIGTERM, and exits straight away on a second one.
+func shutdownOnSignal() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("Received %v, shutting down...", sig)
+	go func() {
+		<-sigs
+		log.Fatal("Exiting without finishing the shutdown.")
+	}()
+	if err := internal.Shutdown(shutdownTimeout); err != nil {
+		log.Println(err)
+	}
+}
+
+// reloadOnHangup reloads the config on SIGHUP, keeping the current settings if it's invalid.
+func reloadOnHangup() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Println("Reloading config", configFile)
+		applied, err := internal.Reload()
+		switch {
+		case err != nil:
+			log.Printf("Reload failed, keeping the current settings: %v", err)
+		case applied:
+			log.Println("Applied reloaded settings.")
+		default:
+			log.Println("Reloaded settings will be applied when the running job finishes.")
+		}
+	}
 }
 
 func listenAddr() string {
@@ -118,6 +270,50 @@ func workerN() int {
 
 }
 
+// validateServer checks the server settings after flags, environment variables and the config file are applied.
+func validateServer() error {
+	if _, _, err := net.SplitHostPort(internal.Addr); err != nil {
+		return fmt.Errorf("addr %q: %v", internal.Addr, err)
+	}
+	serverSettings.Interval = time.Duration(updateFreq) * time.Hour
+	if err := serverSettings.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case internal.FileLimitMax < 1:
+		return fmt.Errorf("ulimit must be at least 1, got %d", internal.FileLimitMax)
+	case internal.RateLimit < 0 || internal.RateBurst < 0 || internal.DailyQuota < 0:
+		return errors.New("rate_limit, rate_burst and daily_quota can't be negative")
+	case internal.DbPath == "":
+		return errors.New("db can't be empty")
+	}
+	if err := internal.ParseTrustedProxies(); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	return nil
+}
+
+// envBool returns true if the environment variable name is 1.
+func envBool(name string) bool {
+	return os.Getenv(name) == "1"
+}
+
+// envString returns the environment variable name, or def if it's not set.
+func envString(name, def string) string {
+	if os.Getenv(name) == "" {
+		return def
+	}
+	return os.Getenv(name)
+}
+
+// envList returns the comma separated values of the environment variable name.
+func envList(name string) []string {
+	if os.Getenv(name) == "" {
+		return nil
+	}
+	return strings.Split(os.Getenv(name), ",")
+}
+
 func maxmindPath() string {
 	maxmindFile := "GeoLite2-Country.mmdb"
 	f := filepath.Join(dataHome(), maxmindFile)
@@ -130,58 +326,63 @@ func dbPath() string {
 	return f
 }
 
+func webhooksPath() string {
+	return filepath.Join(configHome(), "webhooks.json")
+}
+
 func logPath() string {
 	logFile := "server.log"
 	f := filepath.Join(configHome(), logFile)
 	return f
 }
 
-func profileInit() {
+// profileInit starts the trace and cpu profiles and returns a func that stops them and writes the memory profile.
+func profileInit() func() {
+	var stops []func()
+	if traceProfile != "" {
+		f, err := os.Create(traceProfile)
+		if err != nil {
+			log.Fatal("could not create trace profile: ", err)
+		}
+		if err := trace.Start(f); err != nil {
+			log.Fatal("could not start trace profile: ", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
 
-	go func() {
-		defer os.Exit(1)
-		if traceProfile != "" {
-			f, err := os.Create(traceProfile)
-			if err != nil {
-				log.Fatal("could not create trace profile: ", err)
-			}
-			defer f.Close()
-			if err := trace.Start(f); err != nil {
-				log.Fatal("could not start trace profile: ", err)
-			}
-			defer trace.Stop()
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal("could not create CPU profile: ", err)
 		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal("could not start CPU profile: ", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
 
-		if cpuProfile != "" {
-			f, err := os.Create(cpuProfile)
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+		if memProfile != "" {
+			mf, err := os.Create(memProfile)
 			if err != nil {
-				log.Fatal("could not create CPU profile: ", err)
+				log.Fatal("could not create memory profile: ", err)
 			}
-			defer f.Close()
-			if err := pprof.StartCPUProfile(f); err != nil {
-				log.Fatal("could not start CPU profile: ", err)
+			defer mf.Close()
+			runtime.GC() // get up-to-date statistics
+			if err := pprof.WriteHeapProfile(mf); err != nil {
+				log.Fatal("could not write memory profile: ", err)
 			}
-			defer pprof.StopCPUProfile()
 		}
-
-		defer func() {
-			if memProfile != "" {
-				mf, err := os.Create(memProfile)
-				if err != nil {
-					log.Fatal("could not create memory profile: ", err)
-				}
-				defer mf.Close()
-				runtime.GC() // get up-to-date statistics
-				if err := pprof.WriteHeapProfile(mf); err != nil {
-					log.Fatal("could not write memory profile: ", err)
-				}
-			}
-		}()
-
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		<-sigs
-	}()
+	}
 }
 
 func isTerminal(f *os.File) bool {
@@ -192,14 +393,3 @@ func isTerminal(f *os.File) bool {
 	fd := f.Fd()
 	return os.Getenv("TERM") != "dumb" && (isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd))
 }
-
-func schedule() {
-	for {
-		sleepDur := time.Duration(updateFreq) * time.Hour
-		next := time.Now().Add(sleepDur)
-		log.Println("Next proxy download and check scheduled for ", next)
-		time.Sleep(sleepDur)
-		internal.DownloadInit()
-	}
-
-}
@@ -39,5 +39,5 @@ var (
 func init() {
 	rootCmd.AddCommand(statsCmd)
 	statsCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
-	statsCmd.PersistentFlags().IntVarP(&watch, "watch", "w", 0, "Time in seconds to refresh. Set to 0 if you don't to watch.")
+	statsCmd.PersistentFlags().IntVarP(&watch, "watch", "w", 0, "Watch stats, refreshing on changes at most every n seconds. Set to 0 if you don't want to watch.")
 }
@@ -0,0 +1,127 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nicksherron/proxi/client"
+	"github.com/nicksherron/proxi/internal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	workerName   string
+	workerRegion string
+	workerBatch  int
+	workerIdle   time.Duration
+	workerCmd    = &cobra.Command{
+		Use:   "worker",
+		Short: "Check proxies for a server, from this host.",
+		Long: `Lease batches of proxies from a server, check them from this host and post the results back.
+
+Run workers in different places with --region to check proxies from several vantage points
+and to spread checks over more hosts. Proxies a worker in a region last found good can be
+selected with 'proxi get --region'. Workers need a worker or admin api key when the server
+uses --auth.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			if internal.Workers < 1 {
+				internal.Workers = 1
+			}
+			runWorker()
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+	workerCmd.PersistentFlags().StringVarP(&address, "url", "u", fmt.Sprintf("http://%v", listenAddr()), "Url of running ProxyPool server.")
+	workerCmd.PersistentFlags().StringVar(&workerName, "name", hostname(), "Name the server tracks this worker's results under.")
+	workerCmd.PersistentFlags().StringVar(&workerRegion, "region", "default", "Region label for the checks made by this worker, eg us-east.")
+	workerCmd.PersistentFlags().IntVar(&workerBatch, "batch", 100, "Number of proxies to lease at a time.")
+	workerCmd.PersistentFlags().DurationVar(&workerIdle, "idle", time.Minute, "Wait before asking again when no proxies are due or the server can't be reached.")
+	workerCmd.PersistentFlags().DurationVar(&internal.Timeout, "check-timeout", 30*time.Second, "Specify request time out for checking proxies.")
+	workerCmd.PersistentFlags().IntVarP(&internal.Workers, "workers", "w", 20, "Number of proxies to check at once.")
+	workerCmd.PersistentFlags().StringSliceVar(&internal.Judges, "judges", envList("PROXI_JUDGES"), "Extra judge urls to test along with the defaults. The fastest is used for checks.")
+	workerCmd.PersistentFlags().BoolVar(&internal.DebugJudges, "debug-judges", envBool("PROXI_DEBUG_JUDGES"), "Print judge test results and the judge chosen.")
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "worker"
+	}
+	return name
+}
+
+// runWorker leases, checks and reports batches of proxies until killed. Leased proxies that aren't reported
+// are handed out again once their lease expires.
+func runWorker() {
+	c := newClient()
+	ctx := context.Background()
+	log.Printf("Worker %v checking proxies from %v for %v", workerName, workerRegion, address)
+	for {
+		tasks, err := c.Lease(ctx, workerName, workerRegion, workerBatch)
+		if err != nil {
+			workerError(err)
+			time.Sleep(workerIdle)
+			continue
+		}
+		if len(tasks) == 0 {
+			time.Sleep(workerIdle)
+			continue
+		}
+		proxies := make([]string, len(tasks))
+		for i, t := range tasks {
+			proxies[i] = t.Proxy
+		}
+		results := make([]*client.TaskResult, len(tasks))
+		var good int
+		for i, r := range internal.CheckProxies(proxies) {
+			res := &client.TaskResult{ID: tasks[i].ID, Status: r.Status, Anonymous: r.Anonymous, ExitIP: r.ExitIP, Error: r.Error}
+			if r.Status == "invalid" {
+				res.Status = "fail"
+			}
+			if d, err := time.ParseDuration(r.RespTime); err == nil {
+				res.LatencyMs = d.Milliseconds()
+			}
+			if res.Status == "good" {
+				good++
+			}
+			results[i] = res
+		}
+		if err := c.SubmitResults(ctx, workerName, workerRegion, results); err != nil {
+			workerError(err)
+			continue
+		}
+		log.Printf("Checked %d proxies, %d good", len(results), good)
+	}
+}
+
+// workerError exits on auth errors, which retrying won't fix, and logs anything else.
+func workerError(err error) {
+	if e, ok := err.(*client.APIError); ok && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden) {
+		check(err)
+	}
+	log.Printf("Request to %v failed: %v", address, err)
+}
@@ -33,6 +33,12 @@ var doc = `
       "url": "http://www.apache.org/licenses/LICENSE-2.0.html"
     }
   },
+  "security": [
+    {
+      "ApiKeyAuth": []
+    },
+    {}
+  ],
   "paths": {
     "/get": {
       "get": {
@@ -48,7 +54,7 @@ var doc = `
               "type": "string"
             },
             "allowEmptyValue": true,
-            "description": "Filter by country. Format is 'US', 'CH' etc."
+            "description": "Filter by country. Format is 'US', 'CH' etc. Can be repeated or comma separated."
           },
           {
             "name": "anon",
@@ -59,9 +65,51 @@ var doc = `
             },
             "description": "Only return proxies that where found to be anonymous from tests.  Only need to be present in query params to be true, eg /get?anon",
             "allowEmptyValue": true
+          },
+          {
+            "$ref": "#/components/parameters/status"
+          },
+          {
+            "$ref": "#/components/parameters/source"
+          },
+          {
+            "$ref": "#/components/parameters/region"
+          },
+          {
+            "$ref": "#/components/parameters/exit_country"
+          },
+          {
+            "$ref": "#/components/parameters/include_blocked"
+          },
+          {
+            "$ref": "#/components/parameters/asn"
+          },
+          {
+            "$ref": "#/components/parameters/type"
+          },
+          {
+            "$ref": "#/components/parameters/city"
+          },
+          {
+            "$ref": "#/components/parameters/subdivision"
+          },
+          {
+            "$ref": "#/components/parameters/protocol"
+          },
+          {
+            "$ref": "#/components/parameters/min_success"
+          },
+          {
+            "$ref": "#/components/parameters/checked_since"
+          },
+          {
+            "$ref": "#/components/parameters/max_latency"
           }
         ],
         "responses": {
+          "429": {
+            "description": "rate limit or daily quota exceeded. Retry-After has the number of seconds to wait."
+          },
           "200": {
             "description": "successful operation",
             "content": {
@@ -89,7 +137,7 @@ var doc = `
               "type": "string"
             },
             "allowEmptyValue": true,
-            "description": "Filter by country. Format is 'US', 'CH' etc."
+            "description": "Filter by country. Format is 'US', 'CH' etc. Can be repeated or comma separated."
           },
           {
             "name": "anon",
@@ -109,11 +157,189 @@ var doc = `
               "type": "integer"
             },
             "description": "Number of proxies to return."
+          },
+          {
+            "$ref": "#/components/parameters/status"
+          },
+          {
+            "$ref": "#/components/parameters/source"
+          },
+          {
+            "$ref": "#/components/parameters/region"
+          },
+          {
+            "$ref": "#/components/parameters/exit_country"
+          },
+          {
+            "$ref": "#/components/parameters/include_blocked"
+          },
+          {
+            "$ref": "#/components/parameters/asn"
+          },
+          {
+            "$ref": "#/components/parameters/type"
+          },
+          {
+            "$ref": "#/components/parameters/city"
+          },
+          {
+            "$ref": "#/components/parameters/subdivision"
+          },
+          {
+            "$ref": "#/components/parameters/protocol"
+          },
+          {
+            "$ref": "#/components/parameters/min_success"
+          },
+          {
+            "$ref": "#/components/parameters/checked_since"
+          },
+          {
+            "$ref": "#/components/parameters/max_latency"
+          }
+        ],
+        "responses": {
+          "429": {
+            "description": "rate limit or daily quota exceeded. Retry-After has the number of seconds to wait."
+          },
+          "200": {
+            "description": "successful operation",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/ProxyArray"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/proxies": {
+      "get": {
+        "summary": "List proxies matching filters, with pagination.",
+        "description": "Returns proxies matching the filters in a stable order. Use limit and offset, or cursor with the X-Next-Cursor header from the previous page. The total number of matches is returned in the X-Total-Count header.",
+        "operationId": "listProxies",
+        "parameters": [
+          {
+            "name": "country",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "string"
+            },
+            "description": "Filter by country. Format is 'US', 'CH' etc. Can be repeated or comma separated."
+          },
+          {
+            "name": "anon",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "boolean"
+            },
+            "description": "Filter by anonymity. Only need to be present in query params to be true, eg /proxies?anon",
+            "allowEmptyValue": true
+          },
+          {
+            "$ref": "#/components/parameters/status"
+          },
+          {
+            "$ref": "#/components/parameters/source"
+          },
+          {
+            "$ref": "#/components/parameters/region"
+          },
+          {
+            "$ref": "#/components/parameters/exit_country"
+          },
+          {
+            "$ref": "#/components/parameters/include_blocked"
+          },
+          {
+            "$ref": "#/components/parameters/asn"
+          },
+          {
+            "$ref": "#/components/parameters/type"
+          },
+          {
+            "$ref": "#/components/parameters/city"
+          },
+          {
+            "$ref": "#/components/parameters/subdivision"
+          },
+          {
+            "$ref": "#/components/parameters/protocol"
+          },
+          {
+            "$ref": "#/components/parameters/min_success"
+          },
+          {
+            "$ref": "#/components/parameters/checked_since"
+          },
+          {
+            "$ref": "#/components/parameters/max_latency"
+          },
+          {
+            "name": "sort",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "string",
+              "default": "id"
+            },
+            "description": "Sort field, prefixed with '-' for descending order. One of id, created_at, updated_at, checked_at, check_count, success_count, fail_count, timeout_count, latency, country, exit_country, asn, city, source, proxy or random."
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "integer",
+              "default": 100,
+              "maximum": 10000
+            },
+            "description": "Number of proxies to return."
+          },
+          {
+            "name": "offset",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "integer"
+            },
+            "description": "Number of proxies to skip."
+          },
+          {
+            "name": "cursor",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "integer"
+            },
+            "allowEmptyValue": true,
+            "description": "Value of X-Next-Cursor from the previous page. Leave empty to start from the first page. Orders results by id and ignores offset."
           }
         ],
         "responses": {
+          "429": {
+            "description": "rate limit or daily quota exceeded. Retry-After has the number of seconds to wait."
+          },
           "200": {
             "description": "successful operation",
+            "headers": {
+              "X-Total-Count": {
+                "description": "Number of proxies matching the filters.",
+                "schema": {
+                  "type": "integer"
+                }
+              },
+              "X-Next-Cursor": {
+                "description": "Cursor for the next page when using cursor pagination.",
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            },
             "content": {
               "application/json": {
                 "schema": {
@@ -121,6 +347,9 @@ var doc = `
                 }
               }
             }
+          },
+          "400": {
+            "description": "invalid filter"
           }
         }
       }
@@ -166,6 +395,52 @@ var doc = `
         }
       }
     },
+    "/import": {
+      "post": {
+        "summary": "Import proxies. They are checked with the next check cycle. Requires an admin key when auth is enabled.",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/Import"
+              }
+            }
+          }
+        },
+        "operationId": "importProxies",
+        "responses": {
+          "200": {
+            "description": "successful operation"
+          },
+          "400": {
+            "description": "invalid proxy"
+          }
+        }
+      }
+    },
+    "/report": {
+      "post": {
+        "summary": "Report whether a request through a proxy succeeded. Counted in report_ok and report_fail. Needs a worker or admin key.",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/Report"
+              }
+            }
+          }
+        },
+        "operationId": "reportProxy",
+        "responses": {
+          "200": {
+            "description": "successful operation"
+          },
+          "400": {
+            "description": "missing proxy or ok"
+          }
+        }
+      }
+    },
     "/find": {
       "post": {
         "summary": "Find proxy.",
@@ -212,66 +487,696 @@ var doc = `
         }
       }
     },
-    "/refresh": {
+    "/usage": {
       "get": {
-        "summary": "Re-download and check proxies if the server is not already busying downloading or checking. Returns busy, if so.",
+        "summary": "Shows today's (UTC) /get usage and limits for the requesting api key or ip. Admin keys, or any client when auth is disabled, see every client.",
+        "parameters": [
+        ],
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Usage"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "summary": "Stream pool changes and job progress as server-sent events. Needs an admin key.",
+        "description": "Event types are proxy_good (a proxy passed a check after not being good), proxy_bad (a good proxy failed or timed out), proxy_deleted, download_started, download_finished, check_started, check_progress and check_finished. A ping event is sent every 15 seconds. Clients that fall behind miss events.",
         "parameters": [
+          {
+            "name": "types",
+            "in": "query",
+            "required": false,
+            "schema": {
+              "type": "string"
+            },
+            "description": "Only stream these event types. Can be repeated or comma separated."
+          }
         ],
         "responses": {
           "200": {
             "description": "successful operation",
             "content": {
+              "text/event-stream": {
+                "schema": {
+                  "$ref": "#/components/schemas/Event"
+                }
+              }
             }
           }
         }
       }
     },
-    "/busy": {
+    "/metrics": {
       "get": {
-        "summary": "Checks whether server is busy with downloads or checks.",
+        "summary": "Prometheus metrics for the proxy pool, checks, providers, api requests and db connections. Needs an admin key.",
         "parameters": [
         ],
         "responses": {
           "200": {
             "description": "successful operation",
             "content": {
+              "text/plain": {
+              }
             }
           }
         }
       }
-    }
-  },
-  "components": {
-    "schemas": {
-      "Stats": {
-        "type": "object",
-        "properties": {
-          "total": {
-            "type": "integer",
-            "example": 62594
-          },
-          "timeout": {
-            "type": "integer",
-            "example": 17360
-          },
-          "anon": {
-            "type": "integer",
-            "example": 1727
+    },
+    "/refresh": {
+      "get": {
+        "summary": "Re-download and check proxies if the server is not already busying downloading or checking. Returns busy, if so.",
+        "parameters": [
+        ],
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+            }
           },
-          "recently-checked": {
-            "type": "integer",
-            "example":1024
+          "409": {
+            "description": "busy"
           },
-          "good": {
-            "type": "integer",
-            "example": 1727
+          "503": {
+            "description": "this replica is not the leader, refresh on the leader instead"
           }
         }
-      },
-      "Proxy": {
-        "type": "object",
-        "properties": {
-          "id": {
+      }
+    },
+    "/reload": {
+      "post": {
+        "summary": "Reload the server's config file. Worker count, timeouts, judges, disabled providers, interval and webhooks are applied now, or when the running download or check finishes if busy.",
+        "operationId": "reloadConfig",
+        "responses": {
+          "200": {
+            "description": "the config was valid. applied is false if it waits for the running job"
+          },
+          "400": {
+            "description": "the config is invalid and the current settings are kept"
+          }
+        }
+      }
+    },
+    "/schedule": {
+      "get": {
+        "summary": "Lists the scheduled jobs in the order they run next. download downloads proxies and checks the new ones, check_good re-checks good proxies, check_bad re-checks failed and timed out proxies maxmind updates the maxmind dbs and blocklists reloads the blocklists. Needs an admin key.",
+        "parameters": [
+        ],
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Job"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/worker/lease": {
+      "post": {
+        "summary": "Lease proxies due to be checked from the worker's region. They're handed to other workers in the region if results aren't posted within 10 minutes. Needs a worker or admin key.",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/WorkerRequest"
+              }
+            }
+          }
+        },
+        "operationId": "leaseProxies",
+        "responses": {
+          "200": {
+            "description": "the leased proxies",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/WorkerTask"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/worker/results": {
+      "post": {
+        "summary": "Post the results of leased proxies. They update the proxies and the region's checks. Needs a worker or admin key.",
+        "description": "Results are only recorded for proxies leased to the worker in its region, once per lease. The rest are counted as rejected. Failures outside the default region only count against that region.",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/WorkerRequest"
+              }
+            }
+          }
+        },
+        "operationId": "workerResults",
+        "responses": {
+          "200": {
+            "description": "the number of results recorded and rejected",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "recorded": {
+                      "type": "integer"
+                    },
+                    "rejected": {
+                      "type": "integer"
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "400": {
+            "description": "missing worker or invalid status"
+          }
+        }
+      }
+    },
+    "/workers": {
+      "get": {
+        "summary": "Lists the workers that have checked proxies and their counts. Needs an admin key.",
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "$ref": "#/components/schemas/Worker"
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness probe. Answers ok while the server is serving requests and needs no api key.",
+        "responses": {
+          "200": {
+            "description": "the server is up"
+          }
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness probe. Checks the db can be queried, that the leader has resolved a judge and that there are at least --ready-min-good good proxies. Needs no api key.",
+        "responses": {
+          "200": {
+            "description": "the server is ready",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Readiness"
+                }
+              }
+            }
+          },
+          "503": {
+            "description": "the server isn't ready, see problems",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Readiness"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/health": {
+      "get": {
+        "summary": "Shows that the server is up and whether this replica is the leader running downloads and checks. Needs an admin key.",
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Health"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/busy": {
+      "get": {
+        "summary": "Checks whether server is busy with downloads or checks. Needs an admin key.",
+        "parameters": [
+        ],
+        "responses": {
+          "200": {
+            "description": "successful operation",
+            "content": {
+            }
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "status": {
+        "name": "status",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by last check status, eg good, fail, timeout. Can be repeated or comma separated. /get defaults to good."
+      },
+      "source": {
+        "name": "source",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by the provider the proxy was found on. Can be repeated or comma separated."
+      },
+      "region": {
+        "name": "region",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Only match proxies a worker in one of the regions last found good. Can be repeated or comma separated."
+      },
+      "include_blocked": {
+        "name": "include_blocked",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "boolean"
+        },
+        "allowEmptyValue": true,
+        "description": "Include proxies whose ip or exit ip is on one of the server's blocklists or its deny list. Only needs to be present in query params to be true."
+      },
+      "exit_country": {
+        "name": "exit_country",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by the country of the ip the proxy's requests come from, which is what sites see and can differ from country. Can be repeated or comma separated."
+      },
+      "asn": {
+        "name": "asn",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by the ASN of the proxy's ip, eg 7922 or AS7922. Needs the GeoLite2-ASN db. Can be repeated or comma separated."
+      },
+      "type": {
+        "name": "type",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string",
+          "enum": ["hosting", "residential", "mobile"]
+        },
+        "description": "Filter by network type of the proxy's ip, classified by its ASN with the server's ASN lists. Needs the GeoLite2-ASN db. Can be repeated or comma separated."
+      },
+      "city": {
+        "name": "city",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by the city of the proxy's ip, ignoring case. Needs the GeoLite2-City db. Can be repeated or comma separated."
+      },
+      "subdivision": {
+        "name": "subdivision",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by the state or province of the proxy's ip, ignoring case. Needs the GeoLite2-City db. Can be repeated or comma separated."
+      },
+      "protocol": {
+        "name": "protocol",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Filter by proxy protocol, eg http. Can be repeated or comma separated."
+      },
+      "min_success": {
+        "name": "min_success",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "integer"
+        },
+        "description": "Minimum number of successful checks."
+      },
+      "checked_since": {
+        "name": "checked_since",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Only proxies checked since a RFC3339 time, or a duration ago such as 1h."
+      },
+      "max_latency": {
+        "name": "max_latency",
+        "in": "query",
+        "required": false,
+        "schema": {
+          "type": "string"
+        },
+        "description": "Maximum response time of the last check, eg 2s or 500ms."
+      }
+    },
+    "securitySchemes": {
+      "ApiKeyAuth": {
+        "type": "apiKey",
+        "in": "header",
+        "name": "X-API-Key",
+        "description": "Required when the server is started with --auth. Read keys can use /get, /find, /proxies, /stats and /usage, worker keys can also use /report and /worker, and admin keys can use everything."
+      }
+    },
+    "schemas": {
+      "Import": {
+        "type": "object",
+        "properties": {
+          "proxies": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "example": ["http://59.91.121.113:35665", "59.91.121.114:8080"]
+          },
+          "source": {
+            "type": "string",
+            "example": "paid"
+          }
+        }
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "name": {
+            "type": "string",
+            "example": "check_good"
+          },
+          "schedule": {
+            "type": "string",
+            "example": "0 */6 * * *"
+          },
+          "next_run": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "last_run": {
+            "type": "string",
+            "format": "date-time",
+            "nullable": true
+          },
+          "running": {
+            "type": "boolean",
+            "example": false
+          }
+        }
+      },
+      "WorkerRequest": {
+        "type": "object",
+        "properties": {
+          "worker": {
+            "type": "string",
+            "example": "checker-1"
+          },
+          "region": {
+            "type": "string",
+            "example": "us-east"
+          },
+          "limit": {
+            "type": "integer",
+            "example": 100
+          },
+          "results": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": {
+                  "type": "integer"
+                },
+                "status": {
+                  "type": "string",
+                  "enum": ["good", "fail", "timeout", "error"],
+                  "description": "error when the judge failed rather than the proxy, which keeps the proxy's last result."
+                },
+                "anonymous": {
+                  "type": "boolean"
+                },
+                "latency_ms": {
+                  "type": "integer",
+                  "example": 350
+                },
+                "exit_ip": {
+                  "type": "string",
+                  "description": "the address the judge saw a good check come from",
+                  "example": "59.91.121.200"
+                },
+                "error": {
+                  "type": "string",
+                  "description": "why the check failed, starting with its kind like last_error"
+                }
+              }
+            }
+          }
+        }
+      },
+      "WorkerTask": {
+        "type": "object",
+        "properties": {
+          "id": {
+            "type": "integer"
+          },
+          "proxy": {
+            "type": "string",
+            "example": "http://59.91.121.113:35665"
+          }
+        }
+      },
+      "Readiness": {
+        "type": "object",
+        "properties": {
+          "ready": {
+            "type": "boolean"
+          },
+          "leader": {
+            "type": "boolean"
+          },
+          "db": {
+            "type": "string",
+            "example": "ok"
+          },
+          "judge": {
+            "type": "string",
+            "example": "http://httpbin.org/get?show_env"
+          },
+          "good": {
+            "type": "integer"
+          },
+          "min_good": {
+            "type": "integer"
+          },
+          "problems": {
+            "type": "array",
+            "items": {
+              "type": "string"
+            },
+            "example": ["12 good proxies, want at least 50"]
+          }
+        }
+      },
+      "Health": {
+        "type": "object",
+        "properties": {
+          "status": {
+            "type": "string",
+            "example": "ok"
+          },
+          "replica": {
+            "type": "string",
+            "example": "proxi-1-4242"
+          },
+          "leader": {
+            "type": "boolean"
+          },
+          "ha": {
+            "type": "boolean",
+            "description": "true if replicas share a postgres db and elect a leader"
+          },
+          "leader_since": {
+            "type": "string",
+            "format": "date-time"
+          }
+        }
+      },
+      "Worker": {
+        "type": "object",
+        "properties": {
+          "name": {
+            "type": "string",
+            "example": "checker-1"
+          },
+          "region": {
+            "type": "string",
+            "example": "us-east"
+          },
+          "last_seen": {
+            "type": "string",
+            "format": "date-time"
+          },
+          "checked": {
+            "type": "integer"
+          },
+          "good": {
+            "type": "integer"
+          }
+        }
+      },
+      "Report": {
+        "type": "object",
+        "properties": {
+          "proxy": {
+            "type": "string",
+            "example": "http://59.91.121.113:35665"
+          },
+          "ok": {
+            "type": "boolean",
+            "example": false
+          }
+        }
+      },
+      "Usage": {
+        "type": "object",
+        "properties": {
+          "client": {
+            "type": "string",
+            "example": "key:pxi_1a2b3c4d"
+          },
+          "day": {
+            "type": "string",
+            "example": "2020-01-28"
+          },
+          "requests_today": {
+            "type": "integer",
+            "example": 120
+          },
+          "limited_today": {
+            "type": "integer",
+            "example": 3
+          },
+          "proxies_today": {
+            "type": "integer",
+            "example": 950
+          },
+          "proxies_total": {
+            "type": "integer",
+            "example": 20950
+          },
+          "rate_limit": {
+            "type": "number",
+            "example": 5
+          },
+          "daily_quota": {
+            "type": "integer",
+            "example": 10000
+          }
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "type": {
+            "type": "string",
+            "example": "proxy_good"
+          },
+          "time": {
+            "type": "string",
+            "example": "2020-01-28T04:57:06.613106-05:00"
+          },
+          "data": {
+            "description": "The proxy for proxy events, or checked, total and good counts for job events.",
+            "type": "object"
+          }
+        }
+      },
+      "Stats": {
+        "type": "object",
+        "properties": {
+          "total": {
+            "type": "integer",
+            "example": 62594
+          },
+          "timeout": {
+            "type": "integer",
+            "example": 17360
+          },
+          "anon": {
+            "type": "integer",
+            "example": 1727
+          },
+          "recently-checked": {
+            "type": "integer",
+            "example":1024
+          },
+          "good": {
+            "type": "integer",
+            "example": 1727
+          }
+        }
+      },
+      "Proxy": {
+        "type": "object",
+        "properties": {
+          "id": {
             "type": "integer",
             "format": "int64",
             "example": 21039
@@ -292,6 +1197,48 @@ var doc = `
             "type": "string",
             "example":"IN"
           },
+          "exit_ip": {
+            "type": "string",
+            "description": "the address the judge saw the last good check come from, which is what sites see.",
+            "example": "59.91.121.200"
+          },
+          "exit_country": {
+            "type": "string",
+            "example": "IN"
+          },
+          "exit_differs": {
+            "type": "boolean",
+            "description": "true if exit_ip isn't the proxy's own ip. Always false for proxies listed with a hostname."
+          },
+          "blocked": {
+            "type": "string",
+            "description": "the blocklist the proxy's ip or exit ip is on, or deny for the deny list. Empty if the proxy isn't blocked.",
+            "example": ""
+          },
+          "asn": {
+            "type": "integer",
+            "description": "ASN of the proxy's ip, 0 if unknown.",
+            "example": 9829
+          },
+          "org": {
+            "type": "string",
+            "example": "National Internet Backbone"
+          },
+          "type": {
+            "type": "string",
+            "description": "network type of the proxy's ip, classified by its ASN. Empty if the ASN isn't on one of the server's lists.",
+            "enum": ["", "hosting", "residential", "mobile"],
+            "example": "mobile"
+          },
+          "city": {
+            "type": "string",
+            "example": "Mumbai"
+          },
+          "subdivision": {
+            "type": "string",
+            "description": "state or province of the proxy's ip.",
+            "example": "Maharashtra"
+          },
           "fail_count": {
             "type": "integer",
             "example": 0
@@ -300,6 +1247,11 @@ var doc = `
             "type": "string",
             "example": "good"
           },
+          "last_error": {
+            "type": "string",
+            "description": "why the last check failed, starting with its kind: dns, connection_refused, connection_reset, tls, connect_timeout, read_timeout, bad_status, judge_status, judge_parse, injected or other. Empty if it passed.",
+            "example": "connection_refused: proxyconnect tcp: dial tcp 59.91.121.113:35665: connect: connection refused"
+          },
           "proxy": {
             "type": "string",
             "example": "http://59.91.121.113:35665"
@@ -308,6 +1260,22 @@ var doc = `
             "type": "string",
             "example": "900ms"
           },
+          "checked_at": {
+            "type": "string",
+            "example":"2020-01-28T04:57:06.613106-05:00"
+          },
+          "next_check_at": {
+            "type": "string",
+            "example":"2020-01-28T05:27:06.613106-05:00"
+          },
+          "report_ok": {
+            "type": "integer",
+            "example": 12
+          },
+          "report_fail": {
+            "type": "integer",
+            "example": 1
+          },
           "timeout_count": {
             "type": "integer",
             "example": 1
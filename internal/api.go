@@ -18,13 +18,15 @@ package internal
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nicksherron/proxi/docs"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -32,7 +34,7 @@ import (
 var (
 	// Addr is the listen and serve address for the server.
 	Addr string
-	// LogFile is the file location to store the servers http request logs.
+	// LogFile is the file location to store the servers http request logs, or - for stdout.
 	LogFile string
 	// Version is the current version of the program. In releases this is set as the git tag via build ldflags.
 	Version string
@@ -42,95 +44,279 @@ type proxyLookup struct {
 	Proxy string `form:"proxy" json:"proxy" xml:"proxy"  binding:"required"`
 }
 
-func getLogFile() *os.File {
+type proxyReport struct {
+	Proxy string `form:"proxy" json:"proxy" binding:"required"`
+	OK    *bool  `form:"ok" json:"ok" binding:"required"`
+}
+
+func getLogFile() io.Writer {
+	if LogFile == "-" {
+		return os.Stdout
+	}
 	f, err := os.Create(LogFile)
 	if err != nil {
-		log.Fatal(err)
+		apiLog.Fatal("Can't create the http log", "file", LogFile, "err", err)
 	}
 	return f
+}
 
+// accessLog is the middleware logging each request to the http log in the same format as the other logs.
+func accessLog() gin.HandlerFunc {
+	l := &Logger{out: &logOutput{w: getLogFile()}}
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		l.Info("request", "status", c.Writer.Status(), "method", c.Request.Method, "path", c.Request.URL.RequestURI(),
+			"latency", time.Since(start), "client_ip", clientIP(c.Request), "size", c.Writer.Size())
+	}
 }
 
-// LoggerWithFormatter instance a Logger middleware with the specified log format function.
-func loggerWithFormatterWriter(f gin.LogFormatter) gin.HandlerFunc {
-	return gin.LoggerWithConfig(gin.LoggerConfig{
-		Formatter: f,
-		Output:    getLogFile(),
-	})
+// listProxies returns a page of proxies matching the query filters, with the total
+// number of matches in the X-Total-Count header and, for cursor pagination, the
+// cursor for the next page in X-Next-Cursor.
+func listProxies(c *gin.Context) {
+	f, err := listFilter(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	total, err := countProxies(f)
+	if err != nil {
+		apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := queryProxies(f)
+	if err != nil {
+		apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	if f.UseCursor && int64(len(result)) == f.Limit {
+		c.Header("X-Next-Cursor", strconv.FormatUint(uint64(result[len(result)-1].ID), 10))
+	}
+	if result == nil {
+		result = Proxies{}
+	}
+	c.Set(ctxHandedOut, len(result))
+	c.IndentedJSON(http.StatusOK, result)
 }
 
-// API is the rest api/swagger docs that listen and serves forever.
-func API() {
-	gin.SetMode(gin.ReleaseMode)
+// listFilter parses the filters of /proxies with the page size defaulted and capped.
+func listFilter(c *gin.Context) (ProxyFilter, error) {
+	f, err := parseProxyFilter(c)
+	if err != nil {
+		return f, err
+	}
+	if f.Limit == 0 {
+		f.Limit = defaultListLimit
+	}
+	if f.Limit > maxListLimit {
+		f.Limit = maxListLimit
+	}
+	return f, nil
+}
+
+// listCount returns the most proxies a /proxies request can hand out.
+func listCount(c *gin.Context) (int64, error) {
+	f, err := listFilter(c)
+	return f.Limit, err
+}
+
+// oneProxy is the count of /get, which hands out a single proxy.
+func oneProxy(*gin.Context) (int64, error) {
+	return 1, nil
+}
+
+// proxyCount returns the number of proxies asked for by the :n param of /get/:n, capped like getProxyN caps it.
+func proxyCount(c *gin.Context) (int64, error) {
+	n, err := strconv.ParseInt(c.Param("n"), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid number of proxies %q, must be at least 1", c.Param("n"))
+	}
+	if n > maxListLimit {
+		n = maxListLimit
+	}
+	return n, nil
+}
+
+// router returns the api routes. Read keys can get, find, list and stats proxies and see their own usage, worker
+// keys can also report and check proxies, and everything else needs an admin key.
+func router() *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Recovery())
-	r.Use(loggerWithFormatterWriter(func(param gin.LogFormatterParams) string {
-		// my own format
-		return fmt.Sprintf("[ProxyPool] %v | %3d | %13v | %15s | %-7s  %s\n",
-			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-			param.StatusCode,
-			param.Latency,
-			param.ClientIP,
-			param.Method,
-			param.Path,
-		)
-	}))
-
-	r.POST("/delete", func(c *gin.Context) {
+	r.Use(httpMetrics())
+	r.Use(accessLog())
+
+	// probes don't need an api key.
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+
+	read := r.Group("/", requireRole(RoleRead))
+	report := r.Group("/", requireRole(RoleWorker))
+	worker := r.Group("/worker", requireRole(RoleWorker))
+	admin := r.Group("/", requireRole(RoleAdmin))
+
+	admin.POST("/delete", func(c *gin.Context) {
 		var d proxyLookup
 		c.ShouldBind(&d)
 		result := deleteProxy(d.Proxy)
 		c.IndentedJSON(http.StatusOK, gin.H{"deleted": result})
 	})
 
-	r.POST("/find", func(c *gin.Context) {
+	read.POST("/find", func(c *gin.Context) {
 		var d proxyLookup
 		c.ShouldBind(&d)
 		result := findProxy(d.Proxy)
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.GET("/get", func(c *gin.Context) {
+	report.POST("/report", func(c *gin.Context) {
+		var d proxyReport
+		if err := c.ShouldBind(&d); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := reportProxy(d.Proxy, *d.OK)
+		if err != nil {
+			apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"reported": result})
+	})
+
+	read.GET("/get", rateLimit(oneProxy), func(c *gin.Context) {
 		var ret *Proxy
-		result := getProxyN(1, c)
+		f, err := parseProxyFilter(c)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := getProxyN(1, f)
+		if err != nil {
+			apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 		if len(result) != 0 {
 			ret = result[0]
 		}
+		c.Set(ctxHandedOut, len(result))
 		c.IndentedJSON(http.StatusOK, ret)
 	})
 
-	r.GET("/get/:n", func(c *gin.Context) {
-		n := c.Param("n")
-		num, _ := strconv.Atoi(n)
-		result := getProxyN(int64(num), c)
+	read.GET("/get/:n", rateLimit(proxyCount), func(c *gin.Context) {
+		num, err := proxyCount(c)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		f, err := parseProxyFilter(c)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := getProxyN(num, f)
+		if err != nil {
+			apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(ctxHandedOut, len(result))
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.GET("/getall", func(c *gin.Context) {
-		result := getProxyAll()
+	admin.GET("/getall", func(c *gin.Context) {
+		f, err := parseProxyFilter(c)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := getProxyAll(f)
+		if err != nil {
+			apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.GET("/stats", func(c *gin.Context) {
+	read.GET("/proxies", rateLimit(listCount), listProxies)
+
+	read.GET("/stats", func(c *gin.Context) {
 		result := getStats()
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.GET("/db", func(c *gin.Context) {
+	admin.GET("/db", func(c *gin.Context) {
 		result := DB.Stats()
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.GET("/refresh", func(c *gin.Context) {
-		if busy {
+	admin.GET("/refresh", func(c *gin.Context) {
+		if !IsLeader() {
+			c.String(http.StatusServiceUnavailable, "not the leader")
+		} else if busy {
 			c.String(http.StatusConflict, "busy")
 		} else {
-			go DownloadInit()
+			go func() {
+				DownloadInit(WaitLeader())
+			}()
 			c.String(http.StatusOK, "ok")
 		}
 	})
 
-	r.GET("/busy", func(c *gin.Context) {
+	admin.POST("/reload", reloadConfig)
+
+	admin.POST("/import", func(c *gin.Context) {
+		var body struct {
+			Proxies []string `form:"proxy" json:"proxies"`
+			Source  string   `form:"source" json:"source"`
+		}
+		if err := c.ShouldBind(&body); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := importProxies(body.Proxies, body.Source)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"imported": result})
+	})
+
+	read.GET("/usage", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, getUsageStats(c))
+	})
+
+	admin.GET("/events", streamEvents)
+
+	admin.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	admin.GET("/schedule", getSchedule)
+
+	worker.POST("/lease", leaseHandler)
+
+	worker.POST("/results", resultsHandler)
+
+	admin.GET("/workers", func(c *gin.Context) {
+		workers, err := getWorkers()
+		if err != nil {
+			apiLog.Error("Request failed", "path", c.FullPath(), "err", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, workers)
+	})
+
+	admin.GET("/health", health)
+
+	admin.GET("/busy", func(c *gin.Context) {
 		c.String(http.StatusOK, "%v", busy)
 	})
 
@@ -138,9 +324,27 @@ func API() {
 	swaggerURL := ginSwagger.URL(fmt.Sprintf("http://%v/swagger/doc.json", Addr))
 	docs.SwaggerInfo.Version = Version
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, swaggerURL))
+	return r
+}
 
-	err := r.Run(Addr)
+// API is the rest api/swagger docs that listen and serves until Shutdown has finished.
+func API() {
+	gin.SetMode(gin.ReleaseMode)
+	srv := &http.Server{Addr: Addr, Handler: router()}
+	server.Lock()
+	if stopping.Err() != nil {
+		server.Unlock()
+		<-stopped
+		return
+	}
+	server.http = srv
+	server.Unlock()
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		return
+	}
 	if err != nil {
-		fmt.Println("Error: \t", err)
+		apiLog.Error("Can't serve http", "addr", Addr, "err", err)
 	}
 }
@@ -0,0 +1,185 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RoleRead keys can query proxies and stats.
+	RoleRead = "read"
+	// RoleWorker keys can also lease proxies to check and post results, see 'proxi worker'.
+	RoleWorker = "worker"
+	// RoleAdmin keys can also delete, import and refresh proxies.
+	RoleAdmin = "admin"
+
+	apiKeyPrefix = "pxi_"
+	// APIKeyHeader is the header the api key is sent in. Authorization: Bearer <key> is also accepted.
+	APIKeyHeader = "X-API-Key"
+	ctxAPIKey    = "api_key"
+)
+
+var (
+	// AuthEnabled requires requests to the api to send a valid api key.
+	AuthEnabled bool
+	roleRank    = map[string]int{RoleRead: 1, RoleWorker: 2, RoleAdmin: 3}
+)
+
+// APIKey is an api key record. Only the sha256 hash of the key is stored.
+type APIKey struct {
+	ID        uint       `json:"id" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"created_at"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	Prefix    string     `json:"prefix"`
+	Hash      string     `json:"-" gorm:"type:varchar(64);unique_index"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	// RateLimit and DailyQuota override the server defaults for this key when not 0.
+	RateLimit  float64 `json:"rate_limit" gorm:"default:0"`
+	DailyQuota int64   `json:"daily_quota" gorm:"default:0"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey creates a new api key with the given role and returns the record and the plain text key.
+// The plain text key can't be recovered later. A rateLimit or dailyQuota of 0 uses the server defaults.
+func CreateAPIKey(name, role string, rateLimit float64, dailyQuota int64) (*APIKey, string, error) {
+	if _, ok := roleRank[role]; !ok {
+		return nil, "", fmt.Errorf("invalid role %q, must be %v, %v or %v", role, RoleRead, RoleWorker, RoleAdmin)
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+	k := &APIKey{
+		CreatedAt:  time.Now(),
+		Name:       name,
+		Role:       role,
+		Prefix:     key[:len(apiKeyPrefix)+8],
+		Hash:       hashAPIKey(key),
+		RateLimit:  rateLimit,
+		DailyQuota: dailyQuota,
+	}
+	_, err := DB.Exec(`insert into api_keys("created_at", "name", "role", "prefix", "hash", "rate_limit", "daily_quota")
+							values($1,$2,$3,$4,$5,$6,$7)`,
+		k.CreatedAt, k.Name, k.Role, k.Prefix, k.Hash, k.RateLimit, k.DailyQuota)
+	if err != nil {
+		return nil, "", err
+	}
+	err = DB.QueryRow(`select id from api_keys where hash = $1`, k.Hash).Scan(&k.ID)
+	return k, key, err
+}
+
+// ListAPIKeys returns all api keys, including revoked ones.
+func ListAPIKeys() ([]*APIKey, error) {
+	var keys []*APIKey
+	rows, err := DB.Query(`select "id", "created_at", "name", "role", "prefix", "revoked_at", "rate_limit", "daily_quota"
+ 							from api_keys order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.CreatedAt, &k.Name, &k.Role, &k.Prefix, &k.RevokedAt, &k.RateLimit, &k.DailyQuota); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the key with the given id or prefix and returns the number of keys revoked.
+func RevokeAPIKey(idOrPrefix string) (int64, error) {
+	res, err := DB.Exec(`update api_keys set revoked_at = $1 where revoked_at is null and (cast(id as varchar(20)) = $2 or prefix = $2)`,
+		time.Now(), idOrPrefix)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// lookupAPIKey returns the active key matching key or nil if there isn't one.
+func lookupAPIKey(key string) (*APIKey, error) {
+	var k APIKey
+	err := DB.QueryRow(`select "id", "created_at", "name", "role", "prefix", "rate_limit", "daily_quota" from api_keys
+ 							where hash = $1 and revoked_at is null`,
+		hashAPIKey(key)).Scan(&k.ID, &k.CreatedAt, &k.Name, &k.Role, &k.Prefix, &k.RateLimit, &k.DailyQuota)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// requireRole is middleware that aborts requests without a key of at least role when AuthEnabled is set.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AuthEnabled {
+			c.Next()
+			return
+		}
+		key := requestAPIKey(c)
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "api key required"})
+			return
+		}
+		k, err := lookupAPIKey(key)
+		if err != nil {
+			apiLog.Error("Can't look up api key", "err", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if k == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+			return
+		}
+		if roleRank[k.Role] < roleRank[role] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("api key role %v can't access %v", k.Role, c.Request.URL.Path)})
+			return
+		}
+		c.Set(ctxAPIKey, k)
+		c.Next()
+	}
+}
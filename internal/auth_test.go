@@ -0,0 +1,123 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireRole(t *testing.T) {
+	defer testDB(t, nil)()
+	AuthEnabled = true
+	defer func() { AuthEnabled = false }()
+
+	_, readKey, err := CreateAPIKey("reader", RoleRead, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminRec, adminKey, err := CreateAPIKey("admin", RoleAdmin, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateAPIKey("bad", "root", 0, 0); err == nil {
+		t.Error("CreateAPIKey with invalid role returned no error")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/get", requireRole(RoleRead), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.GET("/refresh", requireRole(RoleAdmin), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	tests := []struct {
+		path string
+		key  string
+		want int
+	}{
+		{"/get", "", http.StatusUnauthorized},
+		{"/get", "pxi_wrong", http.StatusUnauthorized},
+		{"/get", readKey, http.StatusOK},
+		{"/refresh", readKey, http.StatusForbidden},
+		{"/refresh", adminKey, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set(APIKeyHeader, tt.key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %v with key %q = %d; want %d", tt.path, tt.key, w.Code, tt.want)
+		}
+	}
+
+	if n, err := RevokeAPIKey(adminRec.Prefix); err != nil || n != 1 {
+		t.Fatalf("RevokeAPIKey(%v) = %v, %v; want 1", adminRec.Prefix, n, err)
+	}
+	req := httptest.NewRequest("GET", "/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+adminKey)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /refresh with revoked key = %d; want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRouteRoles(t *testing.T) {
+	defer testDB(t, nil)()
+	AuthEnabled = true
+	defer func() { AuthEnabled = false }()
+	defer func(f string) { LogFile = f }(LogFile)
+	LogFile = "-"
+
+	keys := make(map[string]string)
+	for _, role := range []string{RoleRead, RoleWorker, RoleAdmin} {
+		_, key, err := CreateAPIKey(role, role, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = key
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := router()
+	tests := []struct {
+		method, path, role string
+	}{
+		{"GET", "/stats", RoleRead},
+		{"GET", "/usage", RoleRead},
+		{"POST", "/report", RoleWorker},
+		{"POST", "/worker/lease", RoleWorker},
+		{"GET", "/schedule", RoleAdmin},
+		{"GET", "/workers", RoleAdmin},
+		{"GET", "/busy", RoleAdmin},
+	}
+	for _, tt := range tests {
+		for role, key := range keys {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set(APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if forbidden := w.Code == http.StatusForbidden; forbidden != (roleRank[role] < roleRank[tt.role]) {
+				t.Errorf("%v %v with a %v key = %d; want it to need a %v key", tt.method, tt.path, role, w.Code, tt.role)
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlockedDeny is the blocked reason of proxies matching the deny list. Proxies on a blocklist have the
+// blocklist's name as the reason instead.
+const BlockedDeny = "deny"
+
+var (
+	// Blocklists are files of CIDRs or ips, like Spamhaus DROP or FireHOL netsets. Proxies whose ip or exit ip is
+	// on one are blocked and left out of /get unless asked for.
+	Blocklists []string
+	// Allow and Deny are CIDRs, ips or ASNs like AS64500. Proxies matching Allow are never blocked and proxies
+	// matching Deny always are.
+	Allow []string
+	Deny  []string
+
+	// reputation is the loaded blocklists and allow and deny lists, nil when they need loading.
+	reputation struct {
+		sync.Mutex
+		lists *blocklist
+		// load is held while loading the lists so they're only loaded once.
+		load sync.Mutex
+	}
+)
+
+// blocklist matches proxies against the blocklists and the allow and deny lists.
+type blocklist struct {
+	listed    ipSet
+	allow     ipSet
+	deny      ipSet
+	allowASNs map[uint]bool
+	denyASNs  map[uint]bool
+}
+
+// ipRange is the range of ips from lo to hi, in their 16 byte form, on the named list.
+type ipRange struct {
+	lo, hi net.IP
+	name   string
+}
+
+// ipSet is a sorted set of ranges that don't overlap.
+type ipSet []ipRange
+
+func (s *ipSet) add(n *net.IPNet, name string) {
+	lo := n.IP.To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	hi := make(net.IP, net.IPv6len)
+	for i := range hi {
+		hi[i] = lo[i] | ^mask[i]
+	}
+	*s = append(*s, ipRange{lo: lo, hi: hi, name: name})
+}
+
+// merge sorts the ranges and joins the ones that overlap, keeping the name of the first.
+func (s *ipSet) merge() {
+	r := *s
+	sort.Slice(r, func(i, k int) bool { return bytes.Compare(r[i].lo, r[k].lo) < 0 })
+	var merged ipSet
+	for _, v := range r {
+		if n := len(merged); n != 0 && bytes.Compare(v.lo, merged[n-1].hi) <= 0 {
+			if bytes.Compare(v.hi, merged[n-1].hi) > 0 {
+				merged[n-1].hi = v.hi
+			}
+			continue
+		}
+		merged = append(merged, v)
+	}
+	*s = merged
+}
+
+// lookup returns the name of the list ip is on, or "" if it isn't in s.
+func (s ipSet) lookup(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	i := sort.Search(len(s), func(i int) bool { return bytes.Compare(s[i].lo, ip) > 0 })
+	if i > 0 && bytes.Compare(ip, s[i-1].hi) <= 0 {
+		return s[i-1].name
+	}
+	return ""
+}
+
+// parseNet parses a CIDR or a single ip.
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip or CIDR %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseRules adds allow or deny list entries to ips and asns.
+func parseRules(rules []string, ips *ipSet, asns map[uint]bool, name string) error {
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if strings.HasPrefix(strings.ToUpper(r), "AS") {
+			n, err := strconv.ParseUint(r[2:], 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid ASN %q", r)
+			}
+			asns[uint(n)] = true
+			continue
+		}
+		n, err := parseNet(r)
+		if err != nil {
+			return err
+		}
+		ips.add(n, name)
+	}
+	return nil
+}
+
+// validateRules checks that the allow or deny list entries can be parsed.
+func validateRules(rules []string) error {
+	return parseRules(rules, &ipSet{}, map[uint]bool{}, "")
+}
+
+// readBlocklist adds the CIDRs and ips in the file f to s, named after the file. Text after # or ; is a comment,
+// and anything after the first field of a line is ignored, which covers Spamhaus DROP and FireHOL netsets. It
+// returns the number of lines it couldn't parse.
+func readBlocklist(f string, s *ipSet) (int, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	name := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+	invalid := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := parseNet(fields[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+		s.add(n, name)
+	}
+	return invalid, scanner.Err()
+}
+
+// loadBlocklist reads the blocklists and parses the allow and deny lists. Blocklists that can't be read are
+// skipped so a missing file doesn't unblock everything else.
+func loadBlocklist() *blocklist {
+	settings.Lock()
+	files, allow, deny := Blocklists, Allow, Deny
+	settings.Unlock()
+	b := &blocklist{allowASNs: map[uint]bool{}, denyASNs: map[uint]bool{}}
+	for _, f := range files {
+		invalid, err := readBlocklist(f, &b.listed)
+		if err != nil {
+			downloadLog.Warn("Can't read blocklist", "file", f, "err", err)
+			continue
+		}
+		if invalid > 0 {
+			downloadLog.Warn("Skipped invalid blocklist lines", "file", f, "lines", invalid)
+		}
+	}
+	// the lists were validated before they were applied.
+	parseRules(allow, &b.allow, b.allowASNs, "allow")
+	parseRules(deny, &b.deny, b.denyASNs, BlockedDeny)
+	b.listed.merge()
+	b.allow.merge()
+	b.deny.merge()
+	return b
+}
+
+// currentBlocklist returns the loaded blocklist, loading it if needed.
+func currentBlocklist() *blocklist {
+	reputation.load.Lock()
+	defer reputation.load.Unlock()
+	reputation.Lock()
+	b := reputation.lists
+	reputation.Unlock()
+	if b == nil {
+		b = loadBlocklist()
+		reputation.Lock()
+		reputation.lists = b
+		reputation.Unlock()
+	}
+	return b
+}
+
+// blockedReason returns why proxy is blocked, or "" if it isn't.
+func (b *blocklist) blockedReason(proxy *Proxy) string {
+	var ips []net.IP
+	if u, err := url.Parse(proxy.Proxy); err == nil {
+		ips = append(ips, net.ParseIP(u.Hostname()))
+	}
+	if proxy.ExitIP != "" {
+		ips = append(ips, net.ParseIP(proxy.ExitIP))
+	}
+	if b.allowASNs[proxy.ASN] && proxy.ASN != 0 {
+		return ""
+	}
+	for _, ip := range ips {
+		if b.allow.lookup(ip) != "" {
+			return ""
+		}
+	}
+	if b.denyASNs[proxy.ASN] && proxy.ASN != 0 {
+		return BlockedDeny
+	}
+	for _, ip := range ips {
+		if reason := b.deny.lookup(ip); reason != "" {
+			return reason
+		}
+	}
+	for _, ip := range ips {
+		if reason := b.listed.lookup(ip); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// tagBlocked sets whether proxy is blocked.
+func tagBlocked(proxy *Proxy) {
+	proxy.Blocked = currentBlocklist().blockedReason(proxy)
+}
+
+// blocklistsChanged reloads the lists and runs the blocklists job to tag the proxies again. settings must be locked.
+func blocklistsChanged() {
+	reputation.Lock()
+	reputation.lists = nil
+	reputation.Unlock()
+	scheduler.Lock()
+	if j := scheduler.jobs[JobBlocklists]; j != nil {
+		j.NextRun = time.Now()
+	}
+	scheduler.Unlock()
+	select {
+	case settings.scheduleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// refreshBlocklists reloads the blocklists and tags the proxies in the db again, stopping early when ctx is done.
+func refreshBlocklists(ctx context.Context) {
+	start := time.Now()
+	b := loadBlocklist()
+	reputation.Lock()
+	reputation.lists = b
+	reputation.Unlock()
+
+	rows, err := DB.Query(`select "id", "proxy", "asn", "exit_ip", "blocked" from proxies where deleted = false`)
+	if err != nil {
+		dbLog.Error("Can't find proxies", "err", err)
+		return
+	}
+	var proxies Proxies
+	for rows.Next() {
+		var p Proxy
+		if err := rows.Scan(&p.ID, &p.Proxy, &p.ASN, &p.ExitIP, &p.Blocked); err != nil {
+			dbLog.Error("Can't find proxies", "err", err)
+			break
+		}
+		proxies = append(proxies, &p)
+	}
+	rows.Close()
+	blocked, changed := 0, 0
+	for _, p := range proxies {
+		if ctx.Err() != nil {
+			break
+		}
+		reason := b.blockedReason(p)
+		if reason != "" {
+			blocked++
+		}
+		if reason != p.Blocked {
+			p.Blocked = reason
+			dbStoreBlocked(p)
+			changed++
+		}
+	}
+	downloadLog.job().Info("Tagged blocked proxies", "ranges", len(b.listed), "blocked", blocked, "changed", changed,
+		"duration", time.Since(start))
+}
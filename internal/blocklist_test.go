@@ -0,0 +1,76 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlocklists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	drop := filepath.Join(dir, "drop.txt")
+	ioutil.WriteFile(drop, []byte("; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n5.5.0.0/16 ; SBL1\nnot an ip ; SBL2\n"), 0644)
+	netset := filepath.Join(dir, "firehol_level1.netset")
+	ioutil.WriteFile(netset, []byte("#\n# firehol_level1\n#\n5.5.5.0/24\n9.9.9.9\n2001:db8::/32\n"), 0644)
+
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.10.20.1:80", LastStatus: "good"},
+		{Proxy: "http://2.2.2.2:80", LastStatus: "good", ExitIP: "9.9.9.9"},
+		{Proxy: "http://5.5.5.5:80", LastStatus: "good"},
+		{Proxy: "http://3.3.3.3:80", LastStatus: "good", ASN: 64500},
+		{Proxy: "http://4.4.4.4:80", LastStatus: "good"},
+		{Proxy: "http://[2001:db8::1]:80", LastStatus: "good"},
+	})()
+	defer ApplySettings(Settings{})
+	ApplySettings(Settings{Blocklists: []string{drop, netset, filepath.Join(dir, "missing.txt")},
+		Allow: []string{"5.5.5.5"}, Deny: []string{"AS64500"}})
+	refreshBlocklists(context.Background())
+
+	proxies, err := queryProxies(ProxyFilter{IncludeBlocked: true, Sort: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"drop", "firehol_level1", "", BlockedDeny, "", "firehol_level1"}
+	for i, p := range proxies {
+		if p.Blocked != want[i] {
+			t.Errorf("%v blocked = %q; want %q", p.Proxy, p.Blocked, want[i])
+		}
+	}
+	if got, _ := queryProxies(ProxyFilter{}); len(got) != 2 {
+		t.Errorf("found %d proxies that aren't blocked; want 2", len(got))
+	}
+
+	// changing the lists takes effect without restarting.
+	ApplySettings(Settings{Deny: []string{"4.4.4.0/24"}})
+	if p := (&Proxy{Proxy: "http://4.4.4.4:80"}); currentBlocklist().blockedReason(p) != BlockedDeny {
+		t.Errorf("4.4.4.4 isn't denied after the deny list changed")
+	}
+
+	for _, rule := range []string{"AS", "ASx", "1.2.3.4/33", "example.com"} {
+		if validateRules([]string{rule}) == nil {
+			t.Errorf("validateRules(%q) returned no error", rule)
+		}
+	}
+}
@@ -17,13 +17,14 @@
 package internal
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"sort"
@@ -34,6 +35,7 @@ import (
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/nicksherron/proxi/transport"
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -43,25 +45,47 @@ type httpBin struct {
 
 var (
 	checkedProxies Proxies
-	counter        int64
-	realIP         string
-	wgDB           sync.WaitGroup
-	wgC            sync.WaitGroup
-	wgLoop         sync.WaitGroup
+	// storeErr is the last error storing checkedProxies in the running check cycle. mutex guards both.
+	storeErr error
+	// serverChecks are the ids of the proxies in the running check cycle, which stores its results over
+	// whatever the proxies held when the cycle loaded them. mutex guards it.
+	serverChecks = make(map[uint]bool)
+	counter      int64
+	realIP       string
+	// checkGeo locates the exit ips of the proxies checked by checkProxies.
+	checkGeo *geoDB
+	wgDB     sync.WaitGroup
+	wgC      sync.WaitGroup
+	wgLoop   sync.WaitGroup
 	// Workers controls number of max goroutines at a time for checking proxies.
 	Workers int
 	// Timeout sets http request timeouts for proxy checks
 	Timeout time.Duration
 	// Progress determines if we use progress bar when checking proxies.
-	Progress     bool
-	testCount    int64
-	bar          *pb.ProgressBar
-	barTemplate  = `{{string . "message"}}{{counters . }} {{bar . }} {{percent . }} {{speed . "%s req/sec" }}`
-	judgeUrl     string
-	resolveCount int
+	Progress bool
+	// Judges are tried along with the default judges, and the fastest is used for checks.
+	Judges []string
+	// DebugJudges prints the judge test results and the judge chosen.
+	DebugJudges bool
+	// RecheckMin is how long a good proxy waits to be checked again, and the first backoff of failing ones.
+	RecheckMin time.Duration
+	// RecheckMax caps the backoff of failing proxies.
+	RecheckMax time.Duration
+	// Continuous checks proxies as they become due instead of on the check_good and check_bad schedules.
+	Continuous bool
+	// continuousIdle is the wait between looking for due proxies when none were due.
+	continuousIdle = time.Minute
+	testCount      int64
+	checkTotal     int64
+	bar            *pb.ProgressBar
+	barTemplate    = `{{string . "message"}}{{counters . }} {{bar . }} {{percent . }} {{speed . "%s req/sec" }}`
+	judgeUrl       string
+	resolveCount   int
 )
 
-func resolveJudges() {
+// resolveJudges picks the judge that answers best. It returns an error if none answer after a few attempts or
+// ctx is done first.
+func resolveJudges(ctx context.Context) error {
 
 	suffix := "/get?show_env"
 	sites := []string{
@@ -69,11 +93,8 @@ func resolveJudges() {
 		"http://httpbin.net",
 		"http://eu.httpbin.org",
 	}
-	if os.Getenv("PROXI_JUDGES") != "" {
-		for _, v := range strings.Split(os.Getenv("PROXI_JUDGES"), `,`) {
-			sites = append(sites, strings.TrimSpace(v))
-		}
-
+	for _, v := range Judges {
+		sites = append(sites, strings.TrimSpace(v))
 	}
 
 	var sources = struct {
@@ -99,7 +120,7 @@ func resolveJudges() {
 			w.Add(1)
 			go func() {
 				defer w.Done()
-				req, err := http.NewRequest("GET", u, nil)
+				req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 				if err != nil {
 					return
 				}
@@ -138,21 +159,28 @@ func resolveJudges() {
 	}
 	resolveCount++
 	if len(records) == 0 {
+		if ctx.Err() != nil {
+			resolveCount = 0
+			return ctx.Err()
+		}
 		if resolveCount < 3 {
-			log.Printf("Can't connect to test sites. Trying again, attempt %v\n", resolveCount)
-			time.Sleep(5 * time.Second)
-			resolveJudges()
-			return
-		} else {
-			log.Fatal("Something went wrong trying to connect to test sites.")
+			checkLog.Warn("Can't connect to the judges, trying again", "attempt", resolveCount)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			return resolveJudges(ctx)
 		}
+		resolveCount = 0
+		return errors.New("can't connect to the judges")
 	}
+	resolveCount = 0
 
 	sort.Slice(records, func(i, j int) bool {
 		return records[i].Value < records[j].Value
 	})
 
-	if os.Getenv("PROXI_DEBUG_JUDGES") == "1" {
+	if DebugJudges {
 		table := tablewriter.NewWriter(os.Stdout)
 		table.SetHeader([]string{"success_tests", "response_time", "site"})
 		for _, v := range sites {
@@ -163,24 +191,102 @@ func resolveJudges() {
 		table.Render()
 	}
 	judgeUrl = records[0].Key + suffix
-
+	return nil
 }
 
-func hostIP() string {
-	req, err := http.NewRequest("GET", judgeUrl, nil)
-	check(err)
-	curl := &http.Client{}
+// hostIP returns the ip the judge sees requests from this host come from.
+func hostIP(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", judgeUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	curl := &http.Client{Timeout: Timeout}
 	resp, err := curl.Do(req)
-	check(err)
+	if err != nil {
+		return "", fmt.Errorf("can't get this host's ip from the judge: %w", err)
+	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
-	check(err)
+	if err != nil {
+		return "", fmt.Errorf("can't get this host's ip from the judge: %w", err)
+	}
 	var jsonBody httpBin
-	err = json.Unmarshal(body, &jsonBody)
-	return jsonBody.Origin
+	if err := json.Unmarshal(body, &jsonBody); err != nil || jsonBody.Origin == "" {
+		return "", fmt.Errorf("judge %v didn't return this host's ip", judgeUrl)
+	}
+	return jsonBody.Origin, nil
 }
 
-func proxyCheck(proxy *Proxy) {
+// judge requests the judge through proxy and returns the origin ip the judge saw and the response time, which
+// is 0 if the judge didn't respond. The check is abandoned when ctx is done. Errors are a *CheckError.
+func judge(ctx context.Context, proxy string) (string, time.Duration, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return "", 0, &CheckError{Kind: KindOther, Err: err}
+	}
+	client := &http.Client{
+		Timeout:   Timeout,
+		Transport: transport.ForProxy(proxyURL),
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, Timeout+5*time.Second)
+	defer cancel()
+	var connected int32
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&connected, 1) },
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "GET", judgeUrl, nil)
+	if err != nil {
+		return "", 0, &CheckError{Kind: KindOther, Err: err}
+	}
+	req.Header.Set("User-Agent", transport.UserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, classify(err, atomic.LoadInt32(&connected) == 1)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, classify(err, true)
+	}
+	latency := time.Since(start)
+
+	// the judge answers with json, so anything else came from the proxy or something between it and the judge.
+	fromJudge := bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+	if resp.StatusCode != 200 {
+		if fromJudge {
+			return "", 0, &CheckError{Kind: KindJudgeStatus, Err: fmt.Errorf("judge returned %v", resp.Status)}
+		}
+		return "", 0, &CheckError{Kind: KindBadStatus, Err: fmt.Errorf("proxy returned %v", resp.Status)}
+	}
+	if !fromJudge {
+		return "", latency, &CheckError{Kind: KindInjected, Err: fmt.Errorf("response isn't from the judge: %.60q", body)}
+	}
+	var jsonBody httpBin
+	if err := json.Unmarshal(body, &jsonBody); err != nil {
+		return "", latency, &CheckError{Kind: KindJudgeParse, Err: err}
+	}
+	if jsonBody.Origin == "" {
+		return "", latency, &CheckError{Kind: KindJudgeParse, Err: errors.New("judge response has no origin")}
+	}
+	return jsonBody.Origin, latency, nil
+}
+
+func proxyCheck(ctx context.Context, proxy *Proxy) {
+	checkStart := time.Now()
+	prevStatus := proxy.LastStatus
+	// finish publishes the check and hands proxy over to be stored. It must be done before wgC.Done, after
+	// which the proxy belongs to the goroutine saving the results.
+	finish := func() {
+		observeCheck(proxy, time.Since(checkStart))
+		publishCheck(proxy, prevStatus)
+		mutex.Lock()
+		checkedProxies = append(checkedProxies, proxy)
+		mutex.Unlock()
+	}
 
 	proxy.CheckCount++
 
@@ -190,121 +296,227 @@ func proxyCheck(proxy *Proxy) {
 			bar.Add(1)
 		}
 		atomic.AddInt64(&testCount, 1)
-		if r := recover(); r != nil {
-			proxy.LosingStreak++
-			if strings.Contains(fmt.Sprintf("%v", r), "Client.Timeout exceeded while awaiting headers") {
-				proxy.LastStatus = "timeout"
-				proxy.TimeoutCount++
-				mutex.Lock()
-				checkedProxies = append(checkedProxies, proxy)
-				mutex.Unlock()
-				return
-			}
-			proxy.LastStatus = "fail"
-			proxy.FailCount++
-			mutex.Lock()
-			checkedProxies = append(checkedProxies, proxy)
-			mutex.Unlock()
-			return
-		}
 	}()
 
-	if proxy.LosingStreak >= 5 {
+	if retire(proxy) {
 		proxy.Deleted = true
-		mutex.Lock()
-		checkedProxies = append(checkedProxies, proxy)
-		mutex.Unlock()
+		finish()
 		return
 	}
-
-	if proxy.CheckCount > 5 {
-		if float64(proxy.FailCount)/float64(proxy.CheckCount) >= 0.90 {
-			proxy.Deleted = true
-			mutex.Lock()
-			checkedProxies = append(checkedProxies, proxy)
-			mutex.Unlock()
-			return
-		}
+	proxy.Judge = judgeUrl
+	origin, latency, err := judge(ctx, proxy.Proxy)
+	if err != nil && ctx.Err() != nil {
+		// canceled by shutdown or lost leadership, which says nothing about the proxy.
+		return
 	}
-	if proxy.CheckCount > 10 {
-		if float64(proxy.FailCount)/float64(proxy.CheckCount) >= 0.80 {
-			proxy.Deleted = true
-			mutex.Lock()
-			checkedProxies = append(checkedProxies, proxy)
-			mutex.Unlock()
-			return
-		}
+	status, lastError := "good", ""
+	if err != nil {
+		status, lastError = checkStatus(err), err.Error()
 	}
-	prox := proxy.Proxy
-	proxyURL, err := url.Parse(prox)
-	check(err)
-
-	tr := &http.Transport{
-		Proxy:               http.ProxyURL(proxyURL),
-		TLSHandshakeTimeout: 60 * time.Second,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{
-		Timeout:   Timeout,
-		Transport: tr,
+	recordResult(proxy, status, !strings.Contains(origin, realIP), latency, lastError)
+	if status == "good" {
+		checkGeo.locateExit(proxy, exitIP(origin))
 	}
+	tagBlocked(proxy)
+	checkLog.Debug("Checked proxy", "proxy", proxy.Proxy, "status", status, "latency", latency, "error", lastError)
+	finish()
+}
 
-	proxy.Judge = judgeUrl
+// exitIP returns the address the judge saw a request come from. The origin it reports lists the addresses in any
+// X-Forwarded-For header the proxy added before it. exitIP is empty if the request came from this host.
+func exitIP(origin string) string {
+	ips := strings.Split(origin, ",")
+	if ip := strings.TrimSpace(ips[len(ips)-1]); ip != realIP {
+		return ip
+	}
+	return ""
+}
 
-	start := time.Now()
-	ctx, cancel := context.WithTimeout(context.Background(), Timeout+5*time.Second)
-	defer cancel()
+// retire returns true if proxy has failed too often to keep checking.
+func retire(proxy *Proxy) bool {
+	failRate := float64(proxy.FailCount) / float64(proxy.CheckCount)
+	return proxy.LosingStreak >= 5 || (proxy.CheckCount > 5 && failRate >= 0.90) ||
+		(proxy.CheckCount > 10 && failRate >= 0.80)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", judgeUrl, nil)
-	check(err)
-	req.Header.Set("User-Agent", `Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36`)
-	resp, err := client.Do(req)
-	if err != nil {
-		check(err)
+// recordResult updates proxy with the outcome of a check, whether made by proxyCheck or a worker. lastError is
+// the CheckError of a failed check.
+func recordResult(proxy *Proxy, status string, anonymous bool, latency time.Duration, lastError string) {
+	if latency > 0 {
+		latency = latency.Truncate(time.Millisecond)
+		respTime := latency.String()
+		proxy.RespTime = &respTime
+		proxy.LatencyMs = latency.Milliseconds()
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
+	proxy.LastError = lastError
+	if status == "error" {
+		// the judge failed, which says nothing about the proxy, so its status and counts are kept.
 		return
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	check(err)
+	proxy.LastStatus = status
+	switch status {
+	case "good":
+		proxy.Anonymous = anonymous
+		proxy.LosingStreak = 0
+		proxy.SuccessCount++
+	case "timeout":
+		proxy.LosingStreak++
+		proxy.TimeoutCount++
+	default:
+		proxy.LosingStreak++
+		proxy.FailCount++
+	}
+}
 
-	*proxy.RespTime = time.Since(start).Truncate(time.Millisecond).String()
+// CheckResult is the outcome of checking a proxy with CheckProxies.
+type CheckResult struct {
+	Proxy     string `json:"proxy"`
+	Status    string `json:"status"`
+	Anonymous bool   `json:"anonymous"`
+	RespTime  string `json:"response_time,omitempty"`
+	ExitIP    string `json:"exit_ip,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
 
-	var jsonBody httpBin
-	err = json.Unmarshal(body, &jsonBody)
-	check(err)
+// CheckProxies checks proxies against a judge like the check cycle does, without storing them. Up to Workers
+// proxies are checked at a time. Proxies that aren't valid have the status invalid.
+func CheckProxies(proxies []string) []*CheckResult {
+	err := resolveJudges(stopping)
+	if err == nil {
+		realIP, err = hostIP(stopping)
+	}
+	if err != nil {
+		checkLog.Fatal("Can't check proxies", "err", err)
+	}
 
-	if jsonBody.Origin == "" {
-		return
+	results := make([]*CheckResult, len(proxies))
+	sem := make(chan struct{}, Workers)
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		r := &CheckResult{Proxy: p}
+		results[i] = r
+		p, err := normalizeProxy(p)
+		if err != nil {
+			r.Status = "invalid"
+			r.Error = err.Error()
+			continue
+		}
+		r.Proxy = p
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			origin, latency, err := judge(stopping, r.Proxy)
+			if latency > 0 {
+				r.RespTime = latency.Truncate(time.Millisecond).String()
+			}
+			if err != nil {
+				r.Status = checkStatus(err)
+				r.Error = err.Error()
+				return
+			}
+			r.Status = "good"
+			r.Anonymous = !strings.Contains(origin, realIP)
+			r.ExitIP = exitIP(origin)
+		}()
 	}
+	wg.Wait()
+	return results
+}
 
-	if strings.Contains(jsonBody.Origin, realIP) {
-		proxy.Anonymous = false
-	} else {
-		proxy.Anonymous = true
+// CheckInit checks all proxies from GormDB to see if they are transparent or anonymous and if they work.
+// lead is the leader context from WaitLeader, and the checks stop when it's canceled.
+func CheckInit(lead context.Context) {
+	if !startJob(JobCheckAll) {
+		return
 	}
+	defer finishJob()
+	ctx, cancel := jobContext(lead)
+	defer cancel()
+	checkProxies(ctx, dbFind(checkAll))
+}
 
-	proxy.LastStatus = "good"
-	proxy.LosingStreak = 0
-	proxy.SuccessCount++
-	mutex.Lock()
-	checkedProxies = append(checkedProxies, proxy)
-	mutex.Unlock()
+// CheckContinuously checks proxies as their next check comes due, waiting for other downloads and checks
+// between batches. Only the leader checks.
+func CheckContinuously() {
+	for {
+		lead := WaitLeader()
+		if !startJob(JobContinuous) {
+			return
+		}
+		proxies := dueProxies(time.Now())
+		if len(proxies) > 0 {
+			ctx, cancel := jobContext(lead)
+			checkProxies(ctx, proxies)
+			cancel()
+		}
+		finishJob()
+		if len(proxies) == 0 {
+			time.Sleep(continuousIdle)
+		}
+	}
+}
 
+// nextCheck returns how long until proxy should be checked again. Good proxies wait RecheckMin, down to half
+// of it the more often they've failed, and failing proxies back off exponentially with their losing streak
+// up to RecheckMax.
+func nextCheck(proxy *Proxy) time.Duration {
+	if proxy.LastStatus == "good" {
+		score := 1.0
+		if proxy.CheckCount > 0 {
+			score = float64(proxy.SuccessCount) / float64(proxy.CheckCount)
+		}
+		return time.Duration(float64(RecheckMin) * (0.5 + score/2))
+	}
+	d := RecheckMin
+	for i := uint(0); i < proxy.LosingStreak && d < RecheckMax; i++ {
+		d *= 2
+	}
+	if d > RecheckMax {
+		d = RecheckMax
+	}
+	return d
 }
 
-// CheckInit checks all proxies from GormDB to see if they are transparent or anonymous and if they work.
-func CheckInit() {
-	log.Println("Starting proxy checks...")
-	busy = true
-	resolveJudges()
-	if os.Getenv("PROXI_DEBUG_JUDGES") == "1" {
-		fmt.Println(judgeUrl)
+// checkProxies checks proxies and stores the results, stopping early when ctx is done.
+func checkProxies(ctx context.Context, proxies Proxies) {
+	l := checkLog.job()
+	l.Info("Starting proxy checks", "proxies", len(proxies))
+	cycleStart := time.Now()
+	mutex.Lock()
+	for _, proxy := range proxies {
+		serverChecks[proxy.ID] = true
+	}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		for _, proxy := range proxies {
+			delete(serverChecks, proxy.ID)
+		}
+		mutex.Unlock()
+	}()
+	err := resolveJudges(ctx)
+	if err == nil {
+		realIP, err = hostIP(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// shutdown or lost leadership doesn't mean checks are failing, so check_failed is left as it is.
+			l.Info("Check cycle canceled before it started", "proxies", len(proxies))
+			return
+		}
+		l.Error("Can't check proxies", "err", err)
+		cycleAlert(err)
+		return
+	}
+	if DebugJudges {
+		l.Info("Using judge", "judge", judgeUrl)
 	}
-	var proxies Proxies
-	proxies = dbFind()
+	publish(EventCheckStarted, CycleProgress{Total: int64(len(proxies))})
+	checkTotal = int64(len(proxies))
 
 	var limit int64
 
@@ -313,10 +525,12 @@ func CheckInit() {
 	} else {
 		limit = int64(Workers)
 	}
-	log.SetOutput(nil)
+	quietLogs(Progress)
 	atomic.StoreInt64(&testCount, 0)
-	realIP = hostIP()
 	counter = 0
+	fetchMaxmind(ctx)
+	checkGeo = openGeo()
+	defer checkGeo.Close()
 
 	wgLoop.Add(1)
 	if Progress {
@@ -326,9 +540,12 @@ func CheckInit() {
 	go func() {
 		defer wgLoop.Done()
 		for _, proxy := range proxies {
+			if ctx.Err() != nil {
+				break
+			}
 			wgC.Add(1)
 			atomic.AddInt64(&counter, 1)
-			go proxyCheck(proxy)
+			go proxyCheck(ctx, proxy)
 			if atomic.CompareAndSwapInt64(&counter, limit, 0) {
 				wgC.Wait()
 				wgDB.Add(1)
@@ -348,9 +565,24 @@ func CheckInit() {
 	if Progress {
 		bar.Finish()
 	}
-	log.SetOutput(os.Stderr)
-	log.Println("Done checking proxies.")
-	busy = false
+	quietLogs(false)
+	observeCheckCycle(time.Since(cycleStart))
+	st := getStats()
+	publish(EventCheckFinished, CycleProgress{Checked: st.RecentlyChecked, Total: checkTotal, Good: int64(st.Good)})
+	checkAlerts(st.Good)
+	mutex.Lock()
+	err = storeErr
+	storeErr = nil
+	mutex.Unlock()
+	switch {
+	case err != nil:
+		cycleAlert(fmt.Errorf("can't store check results: %w", err))
+	case ctx.Err() != nil:
+		l.Info("Check cycle cut short", "checked", atomic.LoadInt64(&testCount), "proxies", len(proxies))
+	default:
+		cycleAlert(nil)
+	}
+	l.Info("Done checking proxies", "checked", st.RecentlyChecked, "good", st.Good, "duration", time.Since(cycleStart))
 }
 
 func storeCheckedProxies() {
@@ -361,6 +593,11 @@ func storeCheckedProxies() {
 	checkedProxies = Proxies{}
 	mutex.Unlock()
 	for _, proxy := range proxies {
-		dbInsert(proxy)
+		if err := dbInsert(proxy); err != nil {
+			mutex.Lock()
+			storeErr = err
+			mutex.Unlock()
+		}
 	}
+	publish(EventCheckProgress, CycleProgress{Checked: atomic.LoadInt64(&testCount), Total: checkTotal})
 }
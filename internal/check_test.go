@@ -0,0 +1,98 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckProxies(t *testing.T) {
+	judgeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"origin": "1.1.1.1"}`)
+	}))
+	defer judgeSrv.Close()
+	// the fake proxy answers judge requests itself, as if it forwarded them from its own ip.
+	anonProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"origin": "9.9.9.9"}`)
+	}))
+	defer anonProxy.Close()
+	badProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer badProxy.Close()
+
+	Judges = []string{judgeSrv.URL}
+	defer func() { Judges = nil }()
+	Workers, Timeout = 2, 5*time.Second
+
+	results := CheckProxies([]string{anonProxy.URL, badProxy.URL, "not-a-proxy"})
+	want := []struct {
+		status string
+		anon   bool
+	}{{"good", true}, {"fail", false}, {"invalid", false}}
+	for i, r := range results {
+		if r.Status != want[i].status || r.Anonymous != want[i].anon {
+			t.Errorf("CheckProxies %v = %v anonymous %v (%v); want %v anonymous %v", r.Proxy, r.Status, r.Anonymous, r.Error, want[i].status, want[i].anon)
+		}
+	}
+	if results[0].RespTime == "" {
+		t.Errorf("good proxy has no response time")
+	}
+	if results[0].ExitIP != "9.9.9.9" {
+		t.Errorf("good proxy exit ip = %q; want 9.9.9.9", results[0].ExitIP)
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	RecheckMin, RecheckMax = time.Hour, 6*time.Hour
+	defer func() { RecheckMin, RecheckMax = 0, 0 }()
+	tests := []struct {
+		proxy Proxy
+		want  time.Duration
+	}{
+		{Proxy{LastStatus: "good", CheckCount: 4, SuccessCount: 4}, time.Hour},
+		{Proxy{LastStatus: "good", CheckCount: 4, SuccessCount: 2}, 45 * time.Minute},
+		{Proxy{LastStatus: "fail", LosingStreak: 0}, time.Hour},
+		{Proxy{LastStatus: "timeout", LosingStreak: 2}, 4 * time.Hour},
+		{Proxy{LastStatus: "fail", LosingStreak: 4}, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := nextCheck(&tt.proxy); got != tt.want {
+			t.Errorf("nextCheck(%v, streak %d, %d/%d) = %v, want %v", tt.proxy.LastStatus, tt.proxy.LosingStreak,
+				tt.proxy.SuccessCount, tt.proxy.CheckCount, got, tt.want)
+		}
+	}
+
+	// stored proxies aren't due until their next check, and due ones are pushed back when picked.
+	RecheckMin = time.Minute
+	defer testDB(t, Proxies{{Proxy: "http://127.0.0.1:1", LastStatus: "good"}})()
+	loadDb(&Proxy{Proxy: "http://127.0.0.1:2"})
+	now := time.Now()
+	if due := dueProxies(now); len(due) != 1 || due[0].Proxy != "http://127.0.0.1:2" {
+		t.Fatalf("due proxies %v, want only the unchecked one", due)
+	}
+	if due := dueProxies(now); len(due) != 0 {
+		t.Errorf("picked %d proxies again straight away", len(due))
+	}
+	if due := dueProxies(now.Add(2 * time.Minute)); len(due) != 2 {
+		t.Errorf("%d proxies due after RecheckMin, want 2", len(due))
+	}
+}
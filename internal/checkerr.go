@@ -0,0 +1,114 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Kinds of check failure, stored at the start of a proxy's last_error.
+const (
+	KindDNS            = "dns"
+	KindRefused        = "connection_refused"
+	KindReset          = "connection_reset"
+	KindTLS            = "tls"
+	KindConnectTimeout = "connect_timeout"
+	KindReadTimeout    = "read_timeout"
+	// KindBadStatus is an error status from the proxy itself, KindJudgeStatus one the judge answered with.
+	KindBadStatus   = "bad_status"
+	KindJudgeStatus = "judge_status"
+	KindJudgeParse  = "judge_parse"
+	// KindInjected is a response that isn't from the judge at all, like a captive portal or an injected page.
+	KindInjected = "injected"
+	KindOther    = "other"
+)
+
+// CheckError is why a proxy check failed.
+type CheckError struct {
+	Kind string
+	Err  error
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the status recorded for a proxy that failed with e. It's error when the judge failed rather
+// than the proxy, which doesn't count against the proxy.
+func (e *CheckError) Status() string {
+	switch e.Kind {
+	case KindConnectTimeout, KindReadTimeout:
+		return "timeout"
+	case KindJudgeStatus, KindJudgeParse:
+		return "error"
+	}
+	return "fail"
+}
+
+// checkStatus returns the status recorded for a check that failed with err.
+func checkStatus(err error) string {
+	var ce *CheckError
+	if errors.As(err, &ce) {
+		return ce.Status()
+	}
+	return "fail"
+}
+
+// classify returns err as a CheckError. connected is whether the connection to the proxy was made, which
+// tells a timeout connecting from one reading the response.
+func classify(err error, connected bool) *CheckError {
+	var ce *CheckError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+		recErr tls.RecordHeaderError
+	)
+	// socks dial errors aren't wrapped, so fall back on the message.
+	msg := err.Error()
+	kind := KindOther
+	switch {
+	case errors.As(err, &dnsErr) || strings.Contains(msg, "no such host"):
+		kind = KindDNS
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "connection refused"):
+		kind = KindRefused
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		kind = KindReadTimeout
+		if !connected {
+			kind = KindConnectTimeout
+		}
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(msg, "connection reset"):
+		kind = KindReset
+	case errors.As(err, &recErr) || strings.Contains(msg, "tls: "):
+		kind = KindTLS
+	}
+	return &CheckError{Kind: kind, Err: err}
+}
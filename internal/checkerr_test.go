@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestJudgeErrors(t *testing.T) {
+	var servers []*httptest.Server
+	defer func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+	proxy := func(h http.HandlerFunc) string {
+		srv := httptest.NewServer(h)
+		servers = append(servers, srv)
+		return srv.URL
+	}
+	// nothing listens on a closed listener's port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	judgeUrl = "http://judge.test/get?show_env"
+	defer func() { judgeUrl = "" }()
+	Timeout = 500 * time.Millisecond
+	tests := []struct {
+		name   string
+		proxy  string
+		kind   string
+		status string
+	}{
+		{"refused", refused, KindRefused, "fail"},
+		{"reset", proxy(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}), KindReset, "fail"},
+		{"bad status", proxy(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}), KindBadStatus, "fail"},
+		{"judge status", proxy(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": "overloaded"}`)
+		}), KindJudgeStatus, "error"},
+		{"injected", proxy(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "<html>Please log in to the wifi</html>")
+		}), KindInjected, "fail"},
+		{"no origin", proxy(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"headers": {}}`)
+		}), KindJudgeParse, "error"},
+		{"read timeout", proxy(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		}), KindReadTimeout, "timeout"},
+	}
+	for _, tt := range tests {
+		_, _, err := judge(context.Background(), tt.proxy)
+		ce, ok := err.(*CheckError)
+		if !ok {
+			t.Errorf("%v: judge returned %v, want a *CheckError", tt.name, err)
+			continue
+		}
+		if ce.Kind != tt.kind || ce.Status() != tt.status {
+			t.Errorf("%v: got %v (%v), want %v (%v)", tt.name, ce.Kind, ce.Status(), tt.kind, tt.status)
+		}
+	}
+
+	for _, tt := range []struct {
+		err       error
+		connected bool
+		kind      string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "proxy.invalid"}, false, KindDNS},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, false, KindConnectTimeout},
+		{fmt.Errorf("socks connect tcp 1.2.3.4:1080->judge:80: %w", timeoutError{}), true, KindReadTimeout},
+		{fmt.Errorf("remote error: tls: handshake failure"), true, KindTLS},
+	} {
+		if got := classify(tt.err, tt.connected); got.Kind != tt.kind {
+			t.Errorf("classify(%v, %v) = %v, want %v", tt.err, tt.connected, got.Kind, tt.kind)
+		}
+	}
+
+	// judge failures don't count against the proxy.
+	p := &Proxy{LastStatus: "good", CheckCount: 3, SuccessCount: 3}
+	recordResult(p, "error", false, 0, "judge_status: judge returned 503")
+	if p.LastStatus != "good" || p.FailCount != 0 || p.LosingStreak != 0 || p.LastError == "" {
+		t.Errorf("after a judge failure proxy = %+v, want it good with the error noted", p)
+	}
+}
@@ -19,12 +19,10 @@ package internal
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -61,6 +59,33 @@ type Proxy struct {
 	LosingStreak uint    `json:"-" gorm:"default:0"`
 	Deleted      bool    `json:"-" gorm:"default:false"`
 	Judge        string  `json:"-"`
+	// CheckedAt is the last time the proxy was checked.
+	CheckedAt *time.Time `json:"checked_at"`
+	// LatencyMs is RespTime in milliseconds, used for filtering and sorting.
+	LatencyMs int64 `json:"-" gorm:"default:0"`
+	// ReportOK and ReportFail count request outcomes reported by clients using the proxy.
+	ReportOK   uint `json:"report_ok" gorm:"default:0"`
+	ReportFail uint `json:"report_fail" gorm:"default:0"`
+	// NextCheckAt is when the proxy is due to be checked again in continuous mode.
+	NextCheckAt *time.Time `json:"next_check_at"`
+	// ASN and Org are the autonomous system the proxy's ip belongs to, NetworkType classifies it as
+	// hosting, residential or mobile. City and Subdivision (the state or province) are where the ip is.
+	// They're only set when the GeoLite2-ASN and GeoLite2-City dbs are available.
+	ASN         uint   `json:"asn" gorm:"default:0"`
+	Org         string `json:"org" gorm:"default:''"`
+	NetworkType string `json:"type" gorm:"default:''"`
+	City        string `json:"city" gorm:"default:''"`
+	Subdivision string `json:"subdivision" gorm:"default:''"`
+	// ExitIP is the address the judge saw the proxy's last good check come from, and ExitCountry is where it is.
+	// ExitDiffers is true when it isn't the proxy's own ip.
+	ExitIP      string `json:"exit_ip" gorm:"default:''"`
+	ExitCountry string `json:"exit_country" gorm:"default:''"`
+	ExitDiffers bool   `json:"exit_differs" gorm:"default:false"`
+	// Blocked is why the proxy is left out of /get: the name of the blocklist its ip or exit ip is on, or deny.
+	// It's empty if the proxy isn't blocked.
+	Blocked string `json:"blocked" gorm:"default:''"`
+	// LastError is why the last check failed, starting with its kind, eg "connection_refused: dial tcp ...".
+	LastError string `json:"last_error" gorm:"default:''"`
 }
 
 // Proxies is a slice of Proxy
@@ -84,31 +109,32 @@ func DbInit() {
 		//
 		DB, err = sql.Open("postgres", DbPath)
 		if err != nil {
-			log.Fatal(err)
+			dbLog.Fatal("Can't open the db", "err", err)
 		}
 
 		gormdb, err = gorm.Open("postgres", DbPath)
 		if err != nil {
-			log.Fatal(err)
+			dbLog.Fatal("Can't open the db", "err", err)
 		}
 		connectionLimit = 50
 	} else {
 		DbPath = fmt.Sprintf("file:%v?cache=shared&mode=rwc", DbPath)
 		DB, err = sql.Open("sqlite3", DbPath)
 		if err != nil {
-			log.Fatal(err)
+			dbLog.Fatal("Can't open the db", "err", err)
 		}
 		gormdb, err = gorm.Open("sqlite3", DbPath)
 		if err != nil {
-			log.Fatal(err)
+			dbLog.Fatal("Can't open the db", "err", err)
 		}
 		DB.Exec("PRAGMA journal_mode=WAL;")
 		connectionLimit = 1
 
 	}
 	DB.SetMaxOpenConns(connectionLimit)
-	gormdb.AutoMigrate(&Proxy{})
+	gormdb.AutoMigrate(&Proxy{}, &APIKey{}, &Job{}, &RegionCheck{}, &Worker{})
 	gormdb.Model(&Proxy{}).AddIndex("idx_proxy_compound", "deleted", "last_status", "anonymous", "country")
+	gormdb.Model(&Proxy{}).AddIndex("idx_proxy_next_check", "deleted", "next_check_at")
 	// just need gorm for migration.
 	gormdb.Close()
 
@@ -151,7 +177,7 @@ func dbCacheStats() {
 	err := DB.QueryRow(`select "anon", "good", "timeout", "total" 
 							  from proxies_stats`).Scan(&stats.Anon, &stats.Good, &stats.Timeout, &stats.Total)
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Error("Can't read stats", "err", err)
 	}
 }
 
@@ -160,152 +186,186 @@ func dbCacheStats() {
 func loadDb(proxy *Proxy) {
 	defer mutex.Unlock()
 	mutex.Lock()
+	// existing proxies keep their location when the maxmind dbs aren't available.
 	_, err := DB.Exec(`insert into proxies("created_at", "updated_at", "check_count", "country", "fail_count",
- 							"last_status", "proxy", "timeout_count", "source", "success_count", "anonymous", "losing_streak")
- 							VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
- 							ON CONFLICT (proxy) DO UPDATE SET updated_at = EXCLUDED.updated_at
+ 							"last_status", "proxy", "timeout_count", "source", "success_count", "anonymous", "losing_streak",
+ 							"asn", "org", "network_type", "city", "subdivision", "blocked")
+ 							VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18)
+ 							ON CONFLICT (proxy) DO UPDATE SET updated_at = EXCLUDED.updated_at,
+ 							asn = coalesce(nullif(EXCLUDED.asn, 0), proxies.asn),
+ 							org = coalesce(nullif(EXCLUDED.org, ''), proxies.org),
+ 							network_type = coalesce(nullif(EXCLUDED.network_type, ''), proxies.network_type),
+ 							city = coalesce(nullif(EXCLUDED.city, ''), proxies.city),
+ 							subdivision = coalesce(nullif(EXCLUDED.subdivision, ''), proxies.subdivision)
  							`, time.Now(), time.Now(), &proxy.CheckCount, &proxy.Country, &proxy.FailCount,
-		&proxy.LastStatus, &proxy.Proxy, &proxy.TimeoutCount, &proxy.Source, &proxy.SuccessCount, &proxy.Anonymous, &proxy.LosingStreak)
+		&proxy.LastStatus, &proxy.Proxy, &proxy.TimeoutCount, &proxy.Source, &proxy.SuccessCount, &proxy.Anonymous, &proxy.LosingStreak,
+		&proxy.ASN, &proxy.Org, &proxy.NetworkType, &proxy.City, &proxy.Subdivision, &proxy.Blocked)
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Fatal("Can't store proxy", "proxy", proxy.Proxy, "err", err)
 	}
 }
 
-func dbInsert(proxy *Proxy) {
+func dbInsert(proxy *Proxy) error {
 	defer mutex.Unlock()
 	mutex.Lock()
+	next := time.Now().Add(nextCheck(proxy))
+	proxy.NextCheckAt = &next
 	_, err := DB.Exec(`update proxies SET "updated_at" = $1, "check_count" = $2 ,"fail_count" = $3,
  							"last_status" = $4, "timeout_count" = $5, "success_count" = $6, "losing_streak" = $7,
- 							 "deleted" = $8,  "anonymous" = $9 , "proxy" = $10, judge = $11, "resp_time" = $12 where id = $13`,
+ 							 "deleted" = $8,  "anonymous" = $9 , "proxy" = $10, judge = $11, "resp_time" = $12,
+ 							 "checked_at" = $13, "latency_ms" = $14, "next_check_at" = $15, "last_error" = $16,
+ 							 "exit_ip" = $17, "exit_country" = $18, "exit_differs" = $19, "blocked" = $20 where id = $21`,
 		time.Now(), &proxy.CheckCount, &proxy.FailCount, &proxy.LastStatus, &proxy.TimeoutCount,
-		&proxy.SuccessCount, &proxy.LosingStreak, &proxy.Deleted, &proxy.Anonymous, &proxy.Proxy, &proxy.Judge, &proxy.RespTime, &proxy.ID)
+		&proxy.SuccessCount, &proxy.LosingStreak, &proxy.Deleted, &proxy.Anonymous, &proxy.Proxy, &proxy.Judge, &proxy.RespTime,
+		time.Now(), &proxy.LatencyMs, proxy.NextCheckAt, &proxy.LastError, &proxy.ExitIP, &proxy.ExitCountry, &proxy.ExitDiffers,
+		&proxy.Blocked, &proxy.ID)
 
 	if err != nil {
-		log.Println(err)
+		dbLog.Error("Can't store check", "proxy", proxy.Proxy, "err", err)
 	}
+	return err
 }
 
-func dbFind() Proxies {
+// dbStoreLocation stores the location of proxy.
+func dbStoreLocation(proxy *Proxy) {
+	defer mutex.Unlock()
+	mutex.Lock()
+	_, err := DB.Exec(`update proxies set "country" = $1, "asn" = $2, "org" = $3, "network_type" = $4, "city" = $5,
+ 							"subdivision" = $6 where id = $7`,
+		proxy.Country, proxy.ASN, proxy.Org, proxy.NetworkType, proxy.City, proxy.Subdivision, proxy.ID)
+	if err != nil {
+		dbLog.Error("Can't store location", "proxy", proxy.Proxy, "err", err)
+	}
+}
+
+// dbStoreBlocked stores whether proxy is blocked.
+func dbStoreBlocked(proxy *Proxy) {
+	defer mutex.Unlock()
+	mutex.Lock()
+	_, err := DB.Exec(`update proxies set "blocked" = $1 where id = $2`, proxy.Blocked, proxy.ID)
+	if err != nil {
+		dbLog.Error("Can't store blocked", "proxy", proxy.Proxy, "err", err)
+	}
+}
+
+// Conditions for dbFind selecting the proxies checked by each job. checkDue takes the time to check at.
+const (
+	checkAll       = "true"
+	checkUnchecked = "checked_at is null"
+	checkGood      = "last_status = 'good'"
+	checkBad       = "last_status <> 'good' and checked_at is not null"
+	checkDue       = "(next_check_at is null or next_check_at <= $1)"
+)
+
+func dbFind(where string, args ...interface{}) Proxies {
 	var out Proxies
-	rows, err := DB.Query(`SELECT "response_time", "id", "check_count", "fail_count","proxy",
- 										"timeout_count", "success_count", "losing_streak" FROM proxies where deleted = false`)
+	rows, err := DB.Query(`SELECT "resp_time", "id", "check_count", "fail_count","proxy",
+ 										"timeout_count", "success_count", "losing_streak", "last_status", "anonymous",
+ 										"country", "source", "exit_ip", "exit_country", "exit_differs", "asn" FROM proxies
+ 										where deleted = false and `+where, args...)
 	if err != nil {
-		log.Println(err)
+		dbLog.Error("Can't find proxies", "where", where, "err", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var row Proxy
 		err = rows.Scan(&row.RespTime, &row.ID, &row.CheckCount, &row.FailCount, &row.Proxy, &row.TimeoutCount,
-			&row.SuccessCount, &row.LosingStreak)
+			&row.SuccessCount, &row.LosingStreak, &row.LastStatus, &row.Anonymous, &row.Country, &row.Source, &row.ExitIP,
+			&row.ExitCountry, &row.ExitDiffers, &row.ASN)
 		if err != nil {
-			log.Println(err)
+			dbLog.Error("Can't find proxies", "where", where, "err", err)
 		}
 		out = append(out, &row)
 	}
 	return out
 }
 
+// dueProxies returns the proxies due to be checked at now and pushes their next check back by RecheckMin,
+// so proxies that aren't stored after checking aren't picked again straight away.
+func dueProxies(now time.Time) Proxies {
+	proxies := dbFind(checkDue, now)
+	if len(proxies) == 0 {
+		return proxies
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, err := DB.Exec(`update proxies set next_check_at = $1 where deleted = false
+ 							and (next_check_at is null or next_check_at <= $2)`, now.Add(RecheckMin), now)
+	if err != nil {
+		dbLog.Error("Can't lease due proxies", "err", err)
+	}
+	return proxies
+}
+
 //--------------------------------------------------------------------------------------
 
 func findProxy(p string) interface{} {
-	var row Proxy
-	err := DB.QueryRow(`select "resp_time",  "anonymous",   "check_count",   "country",   "created_at",   "fail_count",   "id",
-   						       "last_status",   "proxy",   "source",   "success_count",   "timeout_count",
-   						      "updated_at"  from proxies where proxy = $1`, p).Scan(&row.RespTime, &row.Anonymous,
-		&row.CheckCount, &row.Country, &row.CreatedAt, &row.FailCount, &row.ID,
-		&row.LastStatus, &row.Proxy, &row.Source, &row.SuccessCount, &row.TimeoutCount, &row.UpdatedAt)
-
+	rows, err := DB.Query(fmt.Sprintf(`select %v from proxies where proxy = $1`, proxyColumns), p)
 	if err != nil {
-		log.Println(err)
+		dbLog.Error("Can't find proxy", "proxy", p, "err", err)
+		return nil
 	}
-	if row.Proxy != "" {
-		return row
+	defer rows.Close()
+	if !rows.Next() {
+		return nil
+	}
+	row, err := scanProxy(rows)
+	if err != nil {
+		dbLog.Error("Can't find proxy", "proxy", p, "err", err)
+		return nil
 	}
-	return nil
+	return row
 }
 
-func getProxyN(num int64, c *gin.Context) Proxies {
-	var (
-		proxies Proxies
-		rows    *sql.Rows
-		err     error
-	)
-	_, anon := c.GetQuery("anon")
-	country, countryBool := c.GetQuery("country")
-	country = strings.ToUpper(country)
-
-	if anon {
-		if countryBool {
-			// better performance with sub queries, see https://stackoverflow.com/a/24591688.
-			rows, err = DB.Query(`select "resp_time", "anonymous",   "check_count",   "country",   "created_at",   "fail_count",   "id",
-   						       "last_status",   "proxy",   "source",   "success_count",   "timeout_count",
-   						      "updated_at"  from proxies 
-   						      where id in (select id from proxies where last_status = 'good' and country = $1 and anonymous order by random() limit $2)`, country, num)
-		} else {
-			rows, err = DB.Query(`select "resp_time", "anonymous",   "check_count",   "country",   "created_at",   "fail_count",   "id",
-   						       "last_status",   "proxy",   "source",   "success_count",   "timeout_count",
-   						      "updated_at"  from proxies 
-   						      where id in (select id from proxies where last_status = 'good' and anonymous order by random() limit $1)`, num)
-		}
-	} else {
-		if countryBool {
-			rows, err = DB.Query(`select "resp_time", "anonymous",   "check_count",   "country",   "created_at",   "fail_count",
-							   "id", "last_status",   "proxy",   "source",   "success_count",   "timeout_count", "updated_at"
-							     from proxies where id in (select id from proxies where last_status = 'good' and
-							      country = $1 order by random() limit $2)`, country, num)
-		} else {
-			rows, err = DB.Query(`select "resp_time", "anonymous",   "check_count",   "country",   "created_at",   
-								"fail_count",   "id","last_status",   "proxy",   "source",   "success_count",
-								"timeout_count","updated_at"  from proxies where id in 
-								(select id from proxies where last_status = 'good'  order by random() limit $1)`, num)
-		}
+// reportProxy records the outcome of a client request through p and returns the number of proxies updated.
+func reportProxy(p string, ok bool) (int64, error) {
+	column := "report_fail"
+	if ok {
+		column = "report_ok"
 	}
-
-	defer rows.Close()
-
-	for rows.Next() {
-		var row Proxy
-		err = rows.Scan(&row.RespTime, &row.Anonymous, &row.CheckCount, &row.Country, &row.CreatedAt, &row.FailCount, &row.ID,
-			&row.LastStatus, &row.Proxy, &row.Source, &row.SuccessCount, &row.TimeoutCount, &row.UpdatedAt)
-		if err != nil {
-			log.Fatal(err)
-		}
-		proxies = append(proxies, &row)
+	mutex.Lock()
+	defer mutex.Unlock()
+	res, err := DB.Exec(fmt.Sprintf(`update proxies set %[1]v = %[1]v + 1 where proxy = $1`, column), p)
+	if err != nil {
+		return 0, err
 	}
-	return proxies
+	return res.RowsAffected()
 }
 
-func getProxyAll() Proxies {
-	var proxies Proxies
-	rows, err := DB.Query(`select "resp_time", "anonymous",   "check_count",   "country",   "created_at",   "fail_count",   "id",
-   						       "last_status",   "proxy",   "source",   "success_count",   "timeout_count",
-   						      "updated_at"  from proxies`)
-	if err != nil {
-		log.Fatal(err)
+// getProxyN returns up to num random proxies matching f, at most maxListLimit.
+func getProxyN(num int64, f ProxyFilter) (Proxies, error) {
+	if num < 1 {
+		return nil, nil
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var row Proxy
-		err = rows.Scan(&row.RespTime, &row.Anonymous, &row.CheckCount, &row.Country, &row.CreatedAt, &row.FailCount, &row.ID,
-			&row.LastStatus, &row.Proxy, &row.Source, &row.SuccessCount, &row.TimeoutCount, &row.UpdatedAt)
-		if err != nil {
-			log.Fatal(err)
-		}
-		proxies = append(proxies, &row)
+	if num > maxListLimit {
+		num = maxListLimit
 	}
-	return proxies
+	if len(f.Status) == 0 {
+		f.Status = []string{"good"}
+	}
+	f.Limit = num
+	f.Offset = 0
+	f.UseCursor = false
+	return queryProxies(f)
+}
 
+func getProxyAll(f ProxyFilter) (Proxies, error) {
+	f.IncludeDeleted = true
+	f.IncludeBlocked = true
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	return queryProxies(f)
 }
 
 func deleteProxy(p string) interface{} {
 	row, err := DB.Exec(`delete from proxies where proxy = $1`, p)
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Fatal("Can't delete proxy", "proxy", p, "err", err)
 	}
 	result, err := row.RowsAffected()
 	if err != nil {
-		log.Fatal(err)
+		dbLog.Fatal("Can't delete proxy", "proxy", p, "err", err)
 	}
 	return result
 }
@@ -22,9 +22,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -40,6 +40,10 @@ var (
 	wgD             sync.WaitGroup
 	reader          io.ReadCloser
 	DownloadTimeout time.Duration
+	// Dump writes downloaded proxies to a temp file.
+	Dump bool
+	// ProviderDebug logs how long each provider took and how many proxies it returned at info instead of debug level.
+	ProviderDebug bool
 )
 
 func findSubmatchRange(regex *regexp.Regexp, str string) []string {
@@ -144,207 +148,110 @@ func getKuaidaili(u string) (string, error) {
 
 }
 
+// provider is a proxy source. name matches the Source set on the proxies it returns.
+type provider struct {
+	name  string
+	fetch func(ctx context.Context) Proxies
+}
+
+var providers = []provider{
+	{"us-proxy.org", usProxyP},
+	{"freeproxylists.com", freeproxylistsP},
+	{"webanetlabs.net", webanetlabsP},
+	{"checkerproxy.net", checkerproxyP},
+	{"proxy-list.org", proxyListP},
+	{"aliveproxy.com", aliveproxyP},
+	{"kuaidaili.com", kuaidailiP},
+	{"feiyiproxy.com", feiyiproxyP},
+	{"7yip.cn", yipP},
+	{"ip3366.net", ip3366P},
+	{"proxylist.me", proxylistMeP},
+	{"proxy-list.download", proxylistDownloadP},
+	{"blogspot.com", blogspotP},
+	{"prox.com", proxP},
+	{"my-proxy.com", myProxyP},
+	{"xseo.in", xseoP},
+	{"github.com/clarketm", githubClarketmP},
+	{"github.com/TheSpeed", githubTheSpeedP},
+	{"github.com/sunny9577", githubSunny9577},
+}
+
 // DownloadProxies downloads proxies from providers.
 func DownloadProxies() Proxies {
-	log.Println("Starting proxy downloads...")
-	wgD.Add(19)
+	downloadLog.job().Info("Starting proxy downloads")
 	var providerProxies Proxies
 
 	ctxTimeout := DownloadTimeout
 	// Download from providers
-
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := usProxyP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := freeproxylistsP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := webanetlabsP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := checkerproxyP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := proxyListP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := aliveproxyP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := kuaidailiP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := feiyiproxyP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := yipP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := ip3366P(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := proxylistMeP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := proxylistDownloadP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := blogspotP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := proxP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := myProxyP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := xseoP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := githubClarketmP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := githubTheSpeedP(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
-	go func() {
-		defer wgD.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-		defer cancel()
-		results := githubSunny9577(ctx)
-		mutex.Lock()
-		providerProxies = append(providerProxies, results...)
-		mutex.Unlock()
-	}()
+	for _, p := range providers {
+		if isDisabled(p.name) {
+			continue
+		}
+		wgD.Add(1)
+		go func(p provider) {
+			defer wgD.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+			defer cancel()
+			start := time.Now()
+			results := p.fetch(ctx)
+			observeProviderFetch(p.name, len(results), ctx.Err(), time.Since(start))
+			l := downloadLog.Debug
+			if ProviderDebug {
+				l = downloadLog.Info
+			}
+			l("Downloaded from provider", "provider", p.name, "proxies", len(results), "duration", time.Since(start))
+			providerAlerts(p.name, len(results))
+			mutex.Lock()
+			providerProxies = append(providerProxies, results...)
+			mutex.Unlock()
+		}(p)
+	}
 	wgD.Wait()
 	return providerProxies
 
 }
 
-// DownloadInit initializes DownloadProxies and saves results to GormDB
-func DownloadInit() {
-	busy = true
-	validMaxmind = true
-	providerResults := DownloadProxies()
-	ipDB, err := maxmindDb()
-	if err != nil {
-		validMaxmind = false
+func isDisabled(name string) bool {
+	for _, d := range DisabledProviders {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadInit downloads new proxies then checks all proxies. lead is the leader context from WaitLeader,
+// and the checks stop when it's canceled.
+func DownloadInit(lead context.Context) {
+	if !startJob(JobDownload) {
+		return
 	}
-	var tmpfile *os.File
+	defer finishJob()
+	ctx, cancel := jobContext(lead)
+	defer cancel()
+	storeDownloads(ctx)
+	checkProxies(ctx, dbFind(checkAll))
+}
+
+// storeDownloads downloads proxies from the providers and saves new ones to the db.
+func storeDownloads(ctx context.Context) {
+	start := time.Now()
+	publish(EventDownloadStarted, nil)
+	providerResults := DownloadProxies()
+	downloadDuration.Observe(time.Since(start).Seconds())
+	publish(EventDownloadFinished, CycleProgress{Total: int64(len(providerResults))})
+	fetchMaxmind(ctx)
+	geo := openGeo()
+	defer geo.Close()
+	var (
+		tmpfile *os.File
+		err     error
+	)
 	dumpResults := false
-	if os.Getenv("PROXI_DUMP") == "1" {
+	if Dump {
 		tmpfile, err = ioutil.TempFile("", "proxi-dump.*.txt")
 		if err != nil {
-			log.Fatal(err)
+			downloadLog.Fatal("Can't create the dump file", "err", err)
 		}
 		dumpResults = true
 
@@ -356,17 +263,50 @@ func DownloadInit() {
 		if ip == nil {
 			continue
 		}
-		if validMaxmind {
-			country, err := ipDB.Country(ip)
-			check(err)
-			v.Country = country.Country.IsoCode
-		}
+		geo.locate(v, ip)
+		tagBlocked(v)
 		loadDb(v)
 		if dumpResults {
 			fmt.Fprintln(tmpfile, v)
 		}
 	}
-	log.Println("Done Downloading proxies.")
-	CheckInit()
+	downloadLog.job().Info("Done downloading proxies", "proxies", len(providerResults), "duration", time.Since(start))
+
+}
+
+// normalizeProxy validates p and adds the http scheme if it has none.
+func normalizeProxy(p string) (string, error) {
+	if !strings.Contains(p, "://") {
+		p = "http://" + p
+	}
+	u, err := url.Parse(p)
+	if err != nil || u.Port() == "" || net.ParseIP(u.Hostname()) == nil {
+		return "", fmt.Errorf("invalid proxy %q, expected ip:port or scheme://ip:port", p)
+	}
+	return p, nil
+}
 
+// importProxies normalizes and loads proxies into the db so they are checked with the next check cycle.
+// Proxies without a scheme are assumed to be http.
+func importProxies(proxies []string, source string) (int, error) {
+	if source == "" {
+		source = "import"
+	}
+	var imported Proxies
+	for _, p := range strings.Fields(strings.Join(proxies, "\n")) {
+		p, err := normalizeProxy(p)
+		if err != nil {
+			return 0, err
+		}
+		imported = append(imported, &Proxy{Proxy: p, Source: source})
+	}
+	geo := openGeo()
+	defer geo.Close()
+	for _, v := range imported {
+		u, _ := url.Parse(v.Proxy)
+		geo.locate(v, net.ParseIP(u.Hostname()))
+		tagBlocked(v)
+		loadDb(v)
+	}
+	return len(imported), nil
 }
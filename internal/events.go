@@ -0,0 +1,136 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types streamed from /events.
+const (
+	EventProxyGood        = "proxy_good"
+	EventProxyBad         = "proxy_bad"
+	EventProxyDeleted     = "proxy_deleted"
+	EventDownloadStarted  = "download_started"
+	EventDownloadFinished = "download_finished"
+	EventCheckStarted     = "check_started"
+	EventCheckProgress    = "check_progress"
+	EventCheckFinished    = "check_finished"
+
+	eventBuffer    = 1024
+	eventKeepAlive = 15 * time.Second
+)
+
+// Event is a change in the proxy pool or the state of the download and check jobs.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// CycleProgress is the Data of check and download events.
+type CycleProgress struct {
+	Checked int64 `json:"checked,omitempty"`
+	Total   int64 `json:"total"`
+	Good    int64 `json:"good,omitempty"`
+}
+
+var events = struct {
+	sync.RWMutex
+	subscribers map[chan Event]struct{}
+}{subscribers: make(map[chan Event]struct{})}
+
+func subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+	events.Lock()
+	events.subscribers[ch] = struct{}{}
+	events.Unlock()
+	return ch
+}
+
+func unsubscribe(ch chan Event) {
+	events.Lock()
+	delete(events.subscribers, ch)
+	events.Unlock()
+}
+
+// publish sends an event to all subscribers. Subscribers that fall behind miss events rather than
+// blocking the checker.
+func publish(eventType string, data interface{}) {
+	e := Event{Type: eventType, Time: time.Now(), Data: data}
+	events.RLock()
+	defer events.RUnlock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishCheck publishes proxy events when a check changes whether the proxy is usable.
+func publishCheck(proxy *Proxy, prevStatus string) {
+	p := *proxy
+	switch {
+	case proxy.Deleted:
+		publish(EventProxyDeleted, &p)
+	case proxy.LastStatus == "good" && prevStatus != "good":
+		publish(EventProxyGood, &p)
+	case proxy.LastStatus != "good" && prevStatus == "good":
+		publish(EventProxyBad, &p)
+	}
+}
+
+// streamEvents streams events as server-sent events, optionally filtered with the types query param.
+func streamEvents(c *gin.Context) {
+	types := make(map[string]bool)
+	for _, t := range queryValues(c, "types") {
+		types[t] = true
+	}
+	ch := subscribe()
+	defer unsubscribe(ch)
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Header("Content-Type", "text/event-stream")
+	// send headers now so clients don't wait for the first event.
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-ch:
+			if len(types) == 0 || types[e.Type] {
+				c.SSEvent(e.Type, e)
+			}
+			return true
+		case <-keepAlive.C:
+			c.SSEvent("ping", Event{Type: "ping", Time: time.Now()})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-stopping.Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/events", streamEvents)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events?types=proxy_good,proxy_deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events.RLock()
+		n := len(events.subscribers)
+		events.RUnlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no subscriber after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publishCheck(&Proxy{Proxy: "http://1.1.1.1:80", LastStatus: "good"}, "good")
+	publishCheck(&Proxy{Proxy: "http://2.2.2.2:80", LastStatus: "timeout"}, "good")
+	publishCheck(&Proxy{Proxy: "http://3.3.3.3:80", LastStatus: "good"}, "fail")
+	publishCheck(&Proxy{Proxy: "http://4.4.4.4:80", Deleted: true}, "fail")
+
+	var got []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && len(got) < 2 {
+		if line := scanner.Text(); strings.HasPrefix(line, "event:") && line != "event:ping" {
+			got = append(got, strings.TrimPrefix(line, "event:"))
+		}
+	}
+	want := []string{EventProxyGood, EventProxyDeleted}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,397 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// proxyColumns are the columns scanned by scanProxy, in order.
+	proxyColumns = `"resp_time", "anonymous", "check_count", "country", "created_at", "fail_count", "id",
+					"last_status", "proxy", "source", "success_count", "timeout_count", "updated_at", "checked_at",
+					"report_ok", "report_fail", "next_check_at", "last_error", "asn", "org", "network_type", "city",
+					"subdivision", "exit_ip", "exit_country", "exit_differs", "blocked"`
+	defaultListLimit = 100
+	maxListLimit     = 10000
+)
+
+// sortColumns maps the sort values accepted by the api to their column.
+var sortColumns = map[string]string{
+	"created_at":    "created_at",
+	"updated_at":    "updated_at",
+	"checked_at":    "checked_at",
+	"check_count":   "check_count",
+	"success_count": "success_count",
+	"fail_count":    "fail_count",
+	"timeout_count": "timeout_count",
+	"latency":       "latency_ms",
+	"country":       "country",
+	"exit_country":  "exit_country",
+	"asn":           "asn",
+	"city":          "city",
+	"source":        "source",
+	"proxy":         "proxy",
+	"id":            "id",
+}
+
+// ProxyFilter holds the query parameters used to select proxies.
+type ProxyFilter struct {
+	Status        []string
+	Anon          *bool
+	Countries     []string
+	ExitCountries []string
+	Sources       []string
+	Protocols     []string
+	Regions       []string
+	ASNs          []string
+	Cities        []string
+	Subdivisions  []string
+	MinSuccess    uint
+	CheckedSince  time.Time
+	MaxLatency    time.Duration
+	// Types are network types, eg residential.
+	Types []string
+	// Sort is a column from sortColumns, prefixed with '-' for descending order, or "random".
+	Sort   string
+	Limit  int64
+	Offset int64
+	// Cursor is the last id seen by the client. When set, results are ordered by id and Offset is ignored.
+	Cursor         uint
+	UseCursor      bool
+	IncludeDeleted bool
+	// IncludeBlocked includes proxies on a blocklist or the deny list.
+	IncludeBlocked bool
+}
+
+type queryBuilder struct {
+	where []string
+	args  []interface{}
+}
+
+func (q *queryBuilder) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *queryBuilder) in(column string, values []string) {
+	var params []string
+	for _, v := range values {
+		params = append(params, q.arg(v))
+	}
+	q.where = append(q.where, fmt.Sprintf("%v in (%v)", column, strings.Join(params, ", ")))
+}
+
+// inFold is in ignoring case.
+func (q *queryBuilder) inFold(column string, values []string) {
+	var lower []string
+	for _, v := range values {
+		lower = append(lower, strings.ToLower(v))
+	}
+	q.in("lower("+column+")", lower)
+}
+
+func (q *queryBuilder) clause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(q.where, " and ")
+}
+
+// conditions builds the where clause shared by the select and count queries.
+func (f ProxyFilter) conditions() *queryBuilder {
+	q := &queryBuilder{}
+	if !f.IncludeDeleted {
+		q.where = append(q.where, "deleted = false")
+	}
+	if !f.IncludeBlocked {
+		q.where = append(q.where, "blocked = ''")
+	}
+	if len(f.Status) != 0 {
+		q.in("last_status", f.Status)
+	}
+	if f.Anon != nil {
+		if *f.Anon {
+			q.where = append(q.where, "anonymous")
+		} else {
+			q.where = append(q.where, "not anonymous")
+		}
+	}
+	if len(f.Countries) != 0 {
+		q.in("country", f.Countries)
+	}
+	if len(f.ExitCountries) != 0 {
+		q.in("exit_country", f.ExitCountries)
+	}
+	if len(f.Sources) != 0 {
+		q.in("source", f.Sources)
+	}
+	if len(f.ASNs) != 0 {
+		q.in("asn", f.ASNs)
+	}
+	if len(f.Types) != 0 {
+		q.in("network_type", f.Types)
+	}
+	if len(f.Cities) != 0 {
+		q.inFold("city", f.Cities)
+	}
+	if len(f.Subdivisions) != 0 {
+		q.inFold("subdivision", f.Subdivisions)
+	}
+	if len(f.Protocols) != 0 {
+		var or []string
+		for _, p := range f.Protocols {
+			or = append(or, "proxy like "+q.arg(p+"://%"))
+		}
+		q.where = append(q.where, "("+strings.Join(or, " or ")+")")
+	}
+	if len(f.Regions) != 0 {
+		var params []string
+		for _, r := range f.Regions {
+			params = append(params, q.arg(r))
+		}
+		q.where = append(q.where, fmt.Sprintf(`id in (select proxy_id from region_checks where status = 'good'
+ 							and region in (%v))`, strings.Join(params, ", ")))
+	}
+	if f.MinSuccess > 0 {
+		q.where = append(q.where, "success_count >= "+q.arg(f.MinSuccess))
+	}
+	if !f.CheckedSince.IsZero() {
+		q.where = append(q.where, "checked_at >= "+q.arg(f.CheckedSince))
+	}
+	if f.MaxLatency > 0 {
+		q.where = append(q.where, "latency_ms > 0 and latency_ms <= "+q.arg(f.MaxLatency.Milliseconds()))
+	}
+	if f.UseCursor {
+		q.where = append(q.where, "id > "+q.arg(f.Cursor))
+	}
+	return q
+}
+
+func (f ProxyFilter) orderBy() string {
+	if f.UseCursor {
+		return " order by id"
+	}
+	if f.Sort == "" || f.Sort == "random" {
+		return " order by random()"
+	}
+	dir := "asc"
+	col := f.Sort
+	if strings.HasPrefix(col, "-") {
+		dir = "desc"
+		col = col[1:]
+	}
+	return fmt.Sprintf(" order by %v %v, id", sortColumns[col], dir)
+}
+
+// selectQuery returns the query and args for selecting proxies matching f.
+func (f ProxyFilter) selectQuery() (string, []interface{}) {
+	q := f.conditions()
+	// better performance with sub queries, see https://stackoverflow.com/a/24591688.
+	sub := "select id from proxies" + q.clause() + f.orderBy()
+	if f.Limit > 0 {
+		sub += " limit " + q.arg(f.Limit)
+	}
+	if f.Offset > 0 && !f.UseCursor {
+		sub += " offset " + q.arg(f.Offset)
+	}
+	query := fmt.Sprintf("select %v from proxies where id in (%v)", proxyColumns, sub)
+	if (f.Sort != "" && f.Sort != "random") || f.UseCursor {
+		query += f.orderBy()
+	}
+	return query, q.args
+}
+
+// countQuery returns the query and args for counting proxies matching f, ignoring pagination.
+func (f ProxyFilter) countQuery() (string, []interface{}) {
+	f.UseCursor = false
+	q := f.conditions()
+	return "select count(*) from proxies" + q.clause(), q.args
+}
+
+func scanProxy(rows *sql.Rows) (*Proxy, error) {
+	var row Proxy
+	err := rows.Scan(&row.RespTime, &row.Anonymous, &row.CheckCount, &row.Country, &row.CreatedAt, &row.FailCount, &row.ID,
+		&row.LastStatus, &row.Proxy, &row.Source, &row.SuccessCount, &row.TimeoutCount, &row.UpdatedAt, &row.CheckedAt,
+		&row.ReportOK, &row.ReportFail, &row.NextCheckAt, &row.LastError, &row.ASN, &row.Org, &row.NetworkType,
+		&row.City, &row.Subdivision, &row.ExitIP, &row.ExitCountry, &row.ExitDiffers, &row.Blocked)
+	return &row, err
+}
+
+// queryValues returns all values for a query key, splitting comma separated values.
+func queryValues(c *gin.Context, key string) []string {
+	var out []string
+	for _, v := range c.QueryArray(key) {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// parseProxyFilter reads a ProxyFilter from the query params of c.
+func parseProxyFilter(c *gin.Context) (ProxyFilter, error) {
+	var (
+		f   ProxyFilter
+		err error
+	)
+	f.Status = queryValues(c, "status")
+	for i, s := range f.Status {
+		f.Status[i] = strings.ToLower(s)
+	}
+	// anon only needs to be present to be true, eg /get?anon
+	if v, ok := c.GetQuery("anon"); ok {
+		b := true
+		if v != "" {
+			b, err = strconv.ParseBool(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid anon value %q", v)
+			}
+		}
+		f.Anon = &b
+	}
+	f.Countries = queryValues(c, "country")
+	for i, s := range f.Countries {
+		f.Countries[i] = strings.ToUpper(s)
+	}
+	f.ExitCountries = queryValues(c, "exit_country")
+	for i, s := range f.ExitCountries {
+		f.ExitCountries[i] = strings.ToUpper(s)
+	}
+	f.Sources = queryValues(c, "source")
+	f.Regions = queryValues(c, "region")
+	f.ASNs = queryValues(c, "asn")
+	for i, s := range f.ASNs {
+		// accept AS15169 as well as 15169
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("invalid asn value %q", s)
+		}
+		f.ASNs[i] = strconv.FormatUint(n, 10)
+	}
+	f.Types = queryValues(c, "type")
+	for i, s := range f.Types {
+		f.Types[i] = strings.ToLower(s)
+		switch f.Types[i] {
+		case NetworkHosting, NetworkResidential, NetworkMobile:
+		default:
+			return f, fmt.Errorf("invalid type value %q, expected hosting, residential or mobile", s)
+		}
+	}
+	f.Cities = queryValues(c, "city")
+	f.Subdivisions = queryValues(c, "subdivision")
+	f.Protocols = queryValues(c, "protocol")
+	for i, s := range f.Protocols {
+		f.Protocols[i] = strings.ToLower(s)
+	}
+	if v := c.Query("min_success"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("invalid min_success value %q", v)
+		}
+		f.MinSuccess = uint(n)
+	}
+	if v := c.Query("checked_since"); v != "" {
+		// accept either a timestamp or a duration relative to now, eg 1h
+		if d, err := time.ParseDuration(v); err == nil {
+			f.CheckedSince = time.Now().Add(-d)
+		} else if f.CheckedSince, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid checked_since value %q, expected RFC3339 time or duration", v)
+		}
+	}
+	if v := c.Query("max_latency"); v != "" {
+		f.MaxLatency, err = time.ParseDuration(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid max_latency value %q", v)
+		}
+	}
+	if v := c.Query("sort"); v != "" {
+		if _, ok := sortColumns[strings.TrimPrefix(v, "-")]; !ok && v != "random" {
+			return f, fmt.Errorf("invalid sort value %q", v)
+		}
+		f.Sort = v
+	}
+	if v := c.Query("limit"); v != "" {
+		f.Limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("invalid limit value %q", v)
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		f.Offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || f.Offset < 0 {
+			return f, fmt.Errorf("invalid offset value %q", v)
+		}
+	}
+	// include_blocked only needs to be present to be true, like anon.
+	if v, ok := c.GetQuery("include_blocked"); ok {
+		f.IncludeBlocked = true
+		if v != "" {
+			if f.IncludeBlocked, err = strconv.ParseBool(v); err != nil {
+				return f, fmt.Errorf("invalid include_blocked value %q", v)
+			}
+		}
+	}
+	if v, ok := c.GetQuery("cursor"); ok {
+		f.UseCursor = true
+		if v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid cursor value %q", v)
+			}
+			f.Cursor = uint(n)
+		}
+	}
+	return f, nil
+}
+
+// queryProxies returns the proxies matching f.
+func queryProxies(f ProxyFilter) (Proxies, error) {
+	var proxies Proxies
+	query, args := f.selectQuery()
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := scanProxy(rows)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, row)
+	}
+	return proxies, rows.Err()
+}
+
+// countProxies returns the number of proxies matching f, ignoring pagination.
+func countProxies(f ProxyFilter) (int64, error) {
+	var n int64
+	query, args := f.countQuery()
+	err := DB.QueryRow(query, args...).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testDB initializes a sqlite db in a temp dir and loads proxies into it. The returned func removes it.
+func testDB(t *testing.T, proxies Proxies) func() {
+	dir, err := ioutil.TempDir("", "proxi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DbPath = filepath.Join(dir, "data.db")
+	DbInit()
+	for _, p := range proxies {
+		loadDb(p)
+		var id uint
+		if err := DB.QueryRow(`select id from proxies where proxy = $1`, p.Proxy).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		p.ID = id
+		dbInsert(p)
+	}
+	return func() {
+		DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueryProxies(t *testing.T) {
+	resp := "100ms"
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", Country: "US", Source: "a", LastStatus: "good", Anonymous: true, SuccessCount: 3, LatencyMs: 100, RespTime: &resp,
+			ASN: 13335, Org: "CLOUDFLARENET", NetworkType: NetworkHosting, ExitIP: "5.5.5.5", ExitCountry: "NL", ExitDiffers: true},
+		{Proxy: "http://2.2.2.2:80", Country: "DE", Source: "a", LastStatus: "good", SuccessCount: 1, LatencyMs: 900, RespTime: &resp,
+			ASN: 3320, Org: "Deutsche Telekom AG", NetworkType: NetworkResidential, City: "Berlin", Subdivision: "Land Berlin"},
+		{Proxy: "socks5://3.3.3.3:1080", Country: "US", Source: "b", LastStatus: "timeout", RespTime: &resp},
+	})()
+	anon := true
+	tests := []struct {
+		name   string
+		filter ProxyFilter
+		want   int
+	}{
+		{"all", ProxyFilter{}, 3},
+		{"good", ProxyFilter{Status: []string{"good"}}, 2},
+		{"anon", ProxyFilter{Anon: &anon}, 1},
+		{"countries", ProxyFilter{Countries: []string{"US", "DE"}}, 3},
+		{"country", ProxyFilter{Countries: []string{"DE"}}, 1},
+		{"source", ProxyFilter{Sources: []string{"b"}}, 1},
+		{"protocol", ProxyFilter{Protocols: []string{"socks5"}}, 1},
+		{"exit country", ProxyFilter{ExitCountries: []string{"NL"}}, 1},
+		{"asn", ProxyFilter{ASNs: []string{"13335", "15169"}}, 1},
+		{"type", ProxyFilter{Types: []string{NetworkResidential}}, 1},
+		{"city", ProxyFilter{Cities: []string{"berlin"}}, 1},
+		{"subdivision", ProxyFilter{Subdivisions: []string{"Land Berlin"}}, 1},
+		{"min success", ProxyFilter{MinSuccess: 2}, 1},
+		{"max latency", ProxyFilter{MaxLatency: 500 * time.Millisecond}, 1},
+		{"limit", ProxyFilter{Limit: 2, Sort: "id"}, 2},
+		{"offset", ProxyFilter{Limit: 2, Offset: 2, Sort: "id"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryProxies(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("queryProxies(%+v) returned %d proxies; want %d", tt.filter, len(got), tt.want)
+			}
+			if tt.filter.Limit != 0 {
+				return
+			}
+			n, err := countProxies(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(tt.want) {
+				t.Errorf("countProxies(%+v) = %d; want %d", tt.filter, n, tt.want)
+			}
+		})
+	}
+
+	// loading a proxy again without a location keeps the one it has
+	loadDb(&Proxy{Proxy: "http://2.2.2.2:80"})
+	located, err := queryProxies(ProxyFilter{Cities: []string{"Berlin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(located) != 1 || located[0].ASN != 3320 || located[0].NetworkType != NetworkResidential {
+		t.Errorf("reloaded proxy = %+v; want asn 3320 and type residential", located)
+	}
+
+	sorted, err := queryProxies(ProxyFilter{Sort: "-success_count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sorted[0].Proxy != "http://1.1.1.1:80" {
+		t.Errorf("sort=-success_count first = %v; want http://1.1.1.1:80", sorted[0].Proxy)
+	}
+
+	page, err := queryProxies(ProxyFilter{UseCursor: true, Cursor: sorted[0].ID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 {
+		t.Errorf("cursor page returned %d proxies; want 2", len(page))
+	}
+}
+
+func TestParseProxyFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/proxies?anon&country=us,de&country=fr&sort=-latency&max_latency=2s&cursor=10&asn=AS15169&type=Mobile", nil)
+	f, err := parseProxyFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Anon == nil || !*f.Anon {
+		t.Errorf("anon = %v; want true", f.Anon)
+	}
+	if len(f.Countries) != 3 || f.Countries[0] != "US" {
+		t.Errorf("countries = %v; want [US DE FR]", f.Countries)
+	}
+	if !f.UseCursor || f.Cursor != 10 {
+		t.Errorf("cursor = %v; want 10", f.Cursor)
+	}
+	if len(f.ASNs) != 1 || f.ASNs[0] != "15169" {
+		t.Errorf("asns = %v; want [15169]", f.ASNs)
+	}
+	if len(f.Types) != 1 || f.Types[0] != NetworkMobile {
+		t.Errorf("types = %v; want [mobile]", f.Types)
+	}
+
+	for _, q := range []string{"sort=password", "limit=-1", "max_latency=fast", "anon=maybe", "asn=google", "type=vpn", "include_blocked=maybe"} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/proxies?"+q, nil)
+		if _, err := parseProxyFilter(c); err == nil {
+			t.Errorf("parseProxyFilter(%q) returned no error", q)
+		}
+	}
+}
+
+func TestReportProxy(t *testing.T) {
+	defer testDB(t, Proxies{{Proxy: "http://1.1.1.1:80", LastStatus: "good"}})()
+	for _, ok := range []bool{true, true, false} {
+		if n, err := reportProxy("http://1.1.1.1:80", ok); err != nil || n != 1 {
+			t.Fatalf("reportProxy = %v, %v; want 1", n, err)
+		}
+	}
+	if n, err := reportProxy("http://9.9.9.9:80", true); err != nil || n != 0 {
+		t.Errorf("reportProxy for unknown proxy = %v, %v; want 0", n, err)
+	}
+	p := findProxy("http://1.1.1.1:80").(*Proxy)
+	if p.ReportOK != 2 || p.ReportFail != 1 {
+		t.Errorf("reports = %d ok, %d fail; want 2, 1", p.ReportOK, p.ReportFail)
+	}
+}
+
+func TestGetProxyN(t *testing.T) {
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", LastStatus: "good"},
+		{Proxy: "http://2.2.2.2:80", LastStatus: "good"},
+	})()
+	for n, want := range map[int64]int{0: 0, -5: 0, 1: 1, maxListLimit + 1: 2} {
+		got, err := getProxyN(n, ProxyFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != want {
+			t.Errorf("getProxyN(%d) returned %d proxies; want %d", n, len(got), want)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	for n, ok := range map[string]bool{"abc": false, "0": false, "-5": false, "3": true} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Params = gin.Params{{Key: "n", Value: n}}
+		if _, err := proxyCount(c); (err == nil) != ok {
+			t.Errorf("proxyCount(%q) error = %v; want ok %v", n, err, ok)
+		}
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Params = gin.Params{{Key: "n", Value: "999999999"}}
+	if n, err := proxyCount(c); err != nil || n != maxListLimit {
+		t.Errorf("proxyCount(999999999) = %d, %v; want %d", n, err, maxListLimit)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadyMinGood is the number of good proxies needed for /readyz to report ready.
+var ReadyMinGood int64
+
+// readyTimeout bounds the db queries made by /readyz.
+const readyTimeout = 2 * time.Second
+
+// Readiness is whether the server can serve proxies, and the problems if not.
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// Leader is true if this replica downloads and checks proxies, which is what needs a judge.
+	Leader   bool     `json:"leader"`
+	DB       string   `json:"db"`
+	Judge    string   `json:"judge"`
+	Good     int64    `json:"good"`
+	MinGood  int64    `json:"min_good"`
+	Problems []string `json:"problems"`
+}
+
+// readiness checks the db can be queried, that the leader has resolved a judge and that there are at least
+// ReadyMinGood good proxies.
+func readiness(ctx context.Context) *Readiness {
+	r := &Readiness{Leader: IsLeader(), DB: "ok", Judge: judgeUrl, MinGood: ReadyMinGood, Problems: []string{}}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	err := DB.QueryRowContext(ctx, `select "good" from proxies_stats`).Scan(&r.Good)
+	if err != nil {
+		r.DB = err.Error()
+		r.Problems = append(r.Problems, fmt.Sprintf("db: %v", err))
+	} else if r.Good < ReadyMinGood {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d good proxies, want at least %d", r.Good, ReadyMinGood))
+	}
+	// followers don't check proxies, so they don't resolve a judge.
+	if r.Leader && r.Judge == "" {
+		r.Problems = append(r.Problems, "no judge resolved")
+	}
+	r.Ready = len(r.Problems) == 0
+	return r
+}
+
+// healthz is the liveness probe. It only shows the server is serving requests.
+func healthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz is the readiness probe, answering 503 with the problems when the server isn't ready.
+func readyz(c *gin.Context) {
+	r := readiness(c.Request.Context())
+	code := http.StatusOK
+	if !r.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	c.IndentedJSON(code, r)
+}
+
+// health is the handler showing whether the server is up and which replica leads.
+func health(c *gin.Context) {
+	leadership.Lock()
+	defer leadership.Unlock()
+	h := gin.H{
+		"status":  "ok",
+		"replica": replicaID,
+		"leader":  leadership.leader,
+		"ha":      highAvailability(),
+	}
+	if leadership.leader {
+		h["leader_since"] = leadership.since
+	}
+	c.IndentedJSON(http.StatusOK, h)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadiness(t *testing.T) {
+	cleanup := testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", LastStatus: "good"},
+		{Proxy: "http://2.2.2.2:80", LastStatus: "good"},
+		{Proxy: "http://3.3.3.3:80", LastStatus: "timeout"},
+	})
+	judgeUrl = ""
+	defer func() { ReadyMinGood, judgeUrl = 0, "" }()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/readyz", readyz)
+	get := func() (int, *Readiness) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		var ready Readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &ready); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, &ready
+	}
+
+	ReadyMinGood = 2
+	if code, ready := get(); code != http.StatusOK || !ready.Ready || ready.Good != 2 {
+		t.Errorf("follower with 2 good proxies: got %d %+v, want ready", code, ready)
+	}
+	ReadyMinGood = 3
+	if code, ready := get(); code != http.StatusServiceUnavailable || ready.Ready || len(ready.Problems) != 1 {
+		t.Errorf("min good 3: got %d %+v, want not ready with one problem", code, ready)
+	}
+
+	ReadyMinGood = 0
+	becomeLeader()
+	if code, ready := get(); code != http.StatusServiceUnavailable || !ready.Leader || len(ready.Problems) != 1 {
+		t.Errorf("leader without a judge: got %d %+v, want not ready", code, ready)
+	}
+	judgeUrl = "http://judge/get?show_env"
+	if code, ready := get(); code != http.StatusOK || !ready.Ready {
+		t.Errorf("leader with a judge: got %d %+v, want ready", code, ready)
+	}
+	stepDown()
+
+	cleanup()
+	if code, ready := get(); code != http.StatusServiceUnavailable || ready.DB == "ok" {
+		t.Errorf("closed db: got %d %+v, want not ready", code, ready)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leaderLockKey is the postgres advisory lock held by the leader.
+	leaderLockKey = 0x70726f7869 // "proxi"
+	leaderRetry   = 5 * time.Second
+)
+
+var leadership = struct {
+	sync.Mutex
+	leader bool
+	since  time.Time
+	// ctx is canceled when leadership is lost.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// elected is closed when this replica becomes the leader and replaced when it steps down.
+	elected chan struct{}
+}{elected: make(chan struct{})}
+
+// replicaID identifies this server in /health.
+var replicaID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%d", host, os.Getpid())
+}()
+
+// highAvailability is true when replicas can share the db, which needs postgres.
+func highAvailability() bool {
+	return strings.HasPrefix(DbPath, "postgres://")
+}
+
+// Elect makes this replica the leader, the only one running downloads and checks. With postgres the leader
+// holds an advisory lock on its own connection, so another replica takes over if it stops or loses the
+// connection. Otherwise there can only be one replica and it leads straight away.
+func Elect() {
+	if !highAvailability() {
+		becomeLeader()
+		return
+	}
+	for {
+		conn, err := DB.Conn(context.Background())
+		if err != nil {
+			leaderLog.Error("Can't get a db connection", "err", err)
+			time.Sleep(leaderRetry)
+			continue
+		}
+		var locked bool
+		err = conn.QueryRowContext(context.Background(), `select pg_try_advisory_lock($1)`, leaderLockKey).Scan(&locked)
+		if err != nil || !locked {
+			if err != nil {
+				leaderLog.Error("Can't try the leader lock", "err", err)
+			}
+			conn.Close()
+			time.Sleep(leaderRetry)
+			continue
+		}
+		becomeLeader()
+		// the lock is held as long as the session is, so check the connection is still alive.
+		for {
+			time.Sleep(leaderRetry)
+			ctx, cancel := context.WithTimeout(context.Background(), leaderRetry)
+			_, err := conn.ExecContext(ctx, `select 1`)
+			cancel()
+			if err != nil {
+				leaderLog.Warn("Lost the leader connection", "err", err)
+				break
+			}
+		}
+		stepDown()
+		conn.Close()
+	}
+}
+
+func becomeLeader() {
+	leadership.Lock()
+	defer leadership.Unlock()
+	leadership.leader = true
+	leadership.since = time.Now()
+	leadership.ctx, leadership.cancel = context.WithCancel(context.Background())
+	close(leadership.elected)
+	if highAvailability() {
+		leaderLog.Info("This replica is the leader, running downloads and checks", "replica", replicaID)
+	}
+}
+
+func stepDown() {
+	leadership.Lock()
+	defer leadership.Unlock()
+	leadership.leader = false
+	leadership.cancel()
+	leadership.elected = make(chan struct{})
+	leaderLog.Info("This replica is no longer the leader", "replica", replicaID)
+}
+
+// IsLeader returns true if this replica runs downloads and checks.
+func IsLeader() bool {
+	leadership.Lock()
+	defer leadership.Unlock()
+	return leadership.leader
+}
+
+// jobContext returns a context for a job run while leading with lead, canceled when leadership is lost or the
+// server starts shutting down.
+func jobContext(lead context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(lead)
+	go func() {
+		select {
+		case <-stopping.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// WaitLeader blocks until this replica is the leader and returns a context canceled when it stops being one.
+func WaitLeader() context.Context {
+	for {
+		leadership.Lock()
+		elected, ctx := leadership.elected, leadership.ctx
+		leader := leadership.leader
+		leadership.Unlock()
+		if leader {
+			return ctx
+		}
+		<-elected
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLeadership(t *testing.T) {
+	elected := make(chan struct{})
+	go func() {
+		WaitLeader()
+		close(elected)
+	}()
+	select {
+	case <-elected:
+		t.Fatal("WaitLeader returned before the election")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	Elect()
+	select {
+	case <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("WaitLeader didn't return after the election")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/health", health)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	var h struct {
+		Status      string     `json:"status"`
+		Leader      bool       `json:"leader"`
+		HA          bool       `json:"ha"`
+		LeaderSince *time.Time `json:"leader_since"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || h.Status != "ok" || !h.Leader || h.HA || h.LeaderSince == nil {
+		t.Errorf("got %d %+v, want a leader without ha", w.Code, h)
+	}
+
+	lead := WaitLeader()
+	job, cancel := jobContext(lead)
+	defer cancel()
+	stepDown()
+	select {
+	case <-lead.Done():
+	default:
+		t.Error("leader context not canceled after stepping down")
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(time.Second):
+		t.Error("job context not canceled after stepping down")
+	}
+	if IsLeader() {
+		t.Error("still the leader after stepping down")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels.
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var (
+	levelNames = []string{"debug", "info", "warn", "error"}
+	logLevel   = LevelInfo
+	logJSON    bool
+	// quietLevel is raised to LevelWarn while the progress bar is drawn so logs don't break it up.
+	quietLevel int32
+
+	stderrLog   = &logOutput{w: os.Stderr}
+	logger      = &Logger{out: stderrLog}
+	apiLog      = logger.With("subsystem", "api")
+	checkLog    = logger.With("subsystem", "check")
+	dbLog       = logger.With("subsystem", "db")
+	downloadLog = logger.With("subsystem", "download")
+	leaderLog   = logger.With("subsystem", "leader")
+	metricsLog  = logger.With("subsystem", "metrics")
+	scheduleLog = logger.With("subsystem", "schedule")
+	webhookLog  = logger.With("subsystem", "webhooks")
+	workerLog   = logger.With("subsystem", "workers")
+)
+
+type logOutput struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// Logger writes leveled log lines with fields, as logfmt or json.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// ConfigureLogging sets the minimum level logged (debug, info, warn or error) and the format (text for logfmt
+// or json). Lines from the standard log package are logged at info.
+func ConfigureLogging(level, format string) error {
+	l := -1
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			l = i
+		}
+	}
+	if l < 0 {
+		return fmt.Errorf("log level %q isn't one of %v", level, strings.Join(levelNames, ", "))
+	}
+	switch format {
+	case "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("log format %q isn't text or json", format)
+	}
+	atomic.StoreInt32(&logLevel, int32(l))
+	log.SetFlags(0)
+	log.SetOutput(stdLog{})
+	return nil
+}
+
+// quietLogs only lets warnings and errors through while on is true.
+func quietLogs(on bool) {
+	var l int32
+	if on {
+		l = LevelWarn
+	}
+	atomic.StoreInt32(&quietLevel, l)
+}
+
+// stdLog logs lines written by the standard log package.
+type stdLog struct{}
+
+func (stdLog) Write(p []byte) (int, error) {
+	logger.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// With returns a logger that adds the key value pairs kv to each line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Debug logs msg and the key value pairs kv at debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs msg and the key value pairs kv at info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs msg and the key value pairs kv at warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs msg and the key value pairs kv at error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs msg and the key value pairs kv at error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level int32, msg string, kv []interface{}) {
+	if level < atomic.LoadInt32(&logLevel) || (l.out == stderrLog && level < atomic.LoadInt32(&quietLevel)) {
+		return
+	}
+	fields := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", levelNames[level],
+		"msg", msg}, l.fields...)
+	fields = append(fields, kv...)
+	var b bytes.Buffer
+	if logJSON {
+		writeJSON(&b, fields)
+	} else {
+		writeLogfmt(&b, fields)
+	}
+	b.WriteByte('\n')
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+// logValue returns v as it's logged, with times, errors, durations and other Stringers as strings.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		var v interface{} = "!MISSING"
+		if i+1 < len(fields) {
+			v = logValue(fields[i+1])
+		}
+		s := fmt.Sprint(v)
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(b, "%v=%v", fields[i], s)
+	}
+}
+
+func writeJSON(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		var v interface{} = "!MISSING"
+		if i+1 < len(fields) {
+			v = logValue(fields[i+1])
+		}
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		val, err := json.Marshal(v)
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(v))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+}
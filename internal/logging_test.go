@@ -0,0 +1,89 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	stderrLog.w = &buf
+	defer func() {
+		stderrLog.w = os.Stderr
+		ConfigureLogging("info", "text")
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	if err := ConfigureLogging("warn", "text"); err != nil {
+		t.Fatal(err)
+	}
+	l := checkLog.With("proxy", "http://1.2.3.4:80")
+	l.Info("Checked proxy")
+	l.Warn("Check failed", "latency", 1500*time.Millisecond, "err", errors.New("connection refused"), "status", "")
+	line := strings.TrimSpace(buf.String())
+	if strings.Count(line, "\n") != 0 {
+		t.Fatalf("got %q, want only the warning", buf.String())
+	}
+	for _, want := range []string{`level=warn`, `msg="Check failed"`, `subsystem=check`, `proxy=http://1.2.3.4:80`,
+		`latency=1.5s`, `err="connection refused"`, `status=""`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%q doesn't contain %v", line, want)
+		}
+	}
+
+	buf.Reset()
+	if err := ConfigureLogging("debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("Checked proxy", "good", true)
+	log.Print("from the log package")
+	var lines []map[string]interface{}
+	for _, s := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatalf("%q isn't json: %v", s, err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 || lines[0]["level"] != "debug" || lines[0]["good"] != true ||
+		lines[0]["proxy"] != "http://1.2.3.4:80" || lines[1]["msg"] != "from the log package" {
+		t.Errorf("got %v", lines)
+	}
+
+	buf.Reset()
+	quietLogs(true)
+	l.Info("hidden by the progress bar")
+	quietLogs(false)
+	if buf.Len() != 0 {
+		t.Errorf("logged %q while quiet", buf.String())
+	}
+
+	for _, bad := range [][2]string{{"verbose", "text"}, {"info", "xml"}} {
+		if ConfigureLogging(bad[0], bad[1]) == nil {
+			t.Errorf("ConfigureLogging(%q, %q) returned no error", bad[0], bad[1])
+		}
+	}
+}
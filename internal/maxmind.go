@@ -17,62 +17,569 @@
 package internal
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
 )
 
 var (
 	// MaxmindFilePath is the path to maxmind country db file. Used to resolve the geolocation of proxies.
-	MaxmindFilePath    string
-	maxmindDownloadURL = "https://httpbin.net/GeoLite2-Country.mmdb"
-	validMaxmind       bool
+	MaxmindFilePath string
+	// MaxmindASNFilePath and MaxmindCityFilePath are optional GeoLite2-ASN and GeoLite2-City db files,
+	// used to record the network and city of proxies when they exist.
+	MaxmindASNFilePath  string
+	MaxmindCityFilePath string
+	// MaxmindLicenseKey downloads the dbs from MaxMind when set, including the asn and city dbs. Without it
+	// only the country db is downloaded, from MaxmindURL.
+	MaxmindLicenseKey string
+	// MaxmindURL is where the country db is downloaded from without a license key. It can be a mmdb file or
+	// a tar.gz containing one, and is checked against the checksum at MaxmindURL.sha256 if there is one.
+	MaxmindURL = "https://httpbin.net/GeoLite2-Country.mmdb"
+	// HostingASNFile, MobileASNFile and ResidentialASNFile list the ASNs used to classify proxies by network
+	// type, see readASNs. They're ignored if they don't exist. HostingASNs, MobileASNs and ResidentialASNs are
+	// added to them.
+	HostingASNFile     string
+	MobileASNFile      string
+	ResidentialASNFile string
+	HostingASNs        []uint
+	MobileASNs         []uint
+	ResidentialASNs    []uint
+	maxmindDownloadURL = "https://download.maxmind.com/app/geoip_download"
+	// maxmindClient has a long timeout as the city db is tens of megabytes.
+	maxmindClient = &http.Client{Timeout: 10 * time.Minute}
 )
 
-func downloadFile(f string) (string, error) {
-	out, err := os.Create(f)
-	defer out.Close()
+// Maxmind db editions.
+const (
+	editionCountry = "GeoLite2-Country"
+	editionASN     = "GeoLite2-ASN"
+	editionCity    = "GeoLite2-City"
+)
+
+// maxmindFiles returns the files of the dbs that can be downloaded, by edition.
+func maxmindFiles() map[string]string {
+	files := map[string]string{editionCountry: MaxmindFilePath}
+	if MaxmindLicenseKey != "" {
+		if MaxmindASNFilePath != "" {
+			files[editionASN] = MaxmindASNFilePath
+		}
+		if MaxmindCityFilePath != "" {
+			files[editionCity] = MaxmindCityFilePath
+		}
+	}
+	return files
+}
+
+// maxmindSource returns the urls of the edition db and of its sha256 checksum.
+func maxmindSource(edition string) (string, string) {
+	if MaxmindLicenseKey == "" {
+		return MaxmindURL, MaxmindURL + ".sha256"
+	}
+	v := url.Values{"edition_id": {edition}, "license_key": {MaxmindLicenseKey}, "suffix": {"tar.gz"}}
+	return maxmindDownloadURL + "?" + v.Encode(), maxmindDownloadURL + "?" + v.Encode() + ".sha256"
+}
+
+// updateMaxmind downloads the edition db to f unless f is already up to date. The download is checked against
+// its checksum, when the source has one, and opened to validate it before it replaces f, so a failed download
+// never leaves f partly written. It returns true if f was replaced.
+func updateMaxmind(ctx context.Context, edition, f string) (bool, error) {
+	src, sum := maxmindSource(edition)
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(f); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := maxmindClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, stripLicenseKey(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("bad status: %s", resp.Status)
+	}
 
-	// Get the data
-	resp, err := http.Get(maxmindDownloadURL)
+	dir := filepath.Dir(f)
+	download, err := ioutil.TempFile(dir, "."+filepath.Base(f)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(download.Name())
+	defer download.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(download, hash), resp.Body); err != nil {
+		return false, err
+	}
+	if err := verifyChecksum(ctx, sum, hash.Sum(nil)); err != nil {
+		return false, err
+	}
+	db := download.Name()
+	if _, err := download.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if gz, err := gzip.NewReader(download); err == nil {
+		if db, err = extractMmdb(gz, dir, f); err != nil {
+			return false, err
+		}
+		defer os.Remove(db)
+	}
+	if err := validateMaxmind(db, edition); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(db, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(db, f); err != nil {
+		return false, err
+	}
+	// keep the server's modified time so the next update only downloads a newer db.
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(f, t, t)
+	}
+	return true, nil
+}
+
+// stripLicenseKey removes the license key from the url in errors so it isn't logged.
+func stripLicenseKey(err error) error {
+	if MaxmindLicenseKey == "" {
+		return err
+	}
+	return fmt.Errorf("%v", strings.Replace(err.Error(), url.QueryEscape(MaxmindLicenseKey), "<license_key>", -1))
+}
+
+// verifyChecksum checks sum against the sha256 checksum at src, which is in the format of sha256sum. It's
+// skipped if there's no checksum at src.
+func verifyChecksum(ctx context.Context, src string, sum []byte) error {
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := maxmindClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", err
+		return stripLicenseKey(err)
 	}
 	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("checksum: bad status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return fmt.Errorf("checksum: empty")
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return fmt.Errorf("checksum: %v", err)
+	}
+	if !bytes.Equal(want, sum) {
+		return fmt.Errorf("checksum mismatch: got %x, want %x", sum, want)
+	}
+	return nil
+}
 
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status: %s", resp.Status)
+// extractMmdb writes the mmdb file in the tar r to a temp file in dir and returns its name.
+func extractMmdb(r io.Reader, dir, f string) (string, error) {
+	archive := tar.NewReader(r)
+	for {
+		h, err := archive.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("no mmdb file in archive")
+		}
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasSuffix(h.Name, ".mmdb") {
+			continue
+		}
+		out, err := ioutil.TempFile(dir, "."+filepath.Base(f)+".*")
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(out, archive)
+		out.Close()
+		if err != nil {
+			os.Remove(out.Name())
+			return "", err
+		}
+		return out.Name(), nil
 	}
+}
 
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
+// validateMaxmind checks that f is a db of the same kind as edition, eg any Country db for GeoLite2-Country.
+func validateMaxmind(f, edition string) error {
+	db, err := geoip2.Open(f)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer db.Close()
+	kind := edition[strings.Index(edition, "-"):]
+	if dbType := db.Metadata().DatabaseType; !strings.HasSuffix(dbType, kind) {
+		return fmt.Errorf("downloaded a %v db, want %v", dbType, edition)
 	}
-	return out.Name(), nil
+	return nil
 }
 
-func maxmindDb() (*geoip2.Reader, error) {
-	f := MaxmindFilePath
-	var M string
+// refreshMaxmind updates the maxmind dbs and re-reads the ASN lists, then locates the proxies again if any of them
+// changed, stopping early when ctx is done.
+func refreshMaxmind(ctx context.Context) {
+	changed := false
+	for edition, f := range maxmindFiles() {
+		updated, err := updateMaxmind(ctx, edition, f)
+		if err != nil {
+			downloadLog.job().Warn("Can't update maxmind db", "edition", edition, "err", err)
+			continue
+		}
+		if updated {
+			downloadLog.job().Info("Updated maxmind db", "edition", edition, "file", f)
+			changed = true
+		}
+	}
+	if changed {
+		reloadGeo()
+	}
+	// the ASN lists are re-read with the dbs, and either changing can move proxies.
+	if reloadNetworks() || changed {
+		relocateProxies(ctx)
+	}
+}
 
-	_, err := os.Stat(f)
-	if os.IsNotExist(err) {
-		M, err = downloadFile(f)
+// relocateProxies locates the proxies in the db again and stores the ones whose location changed.
+func relocateProxies(ctx context.Context) {
+	start := time.Now()
+	geo := openGeo()
+	defer geo.Close()
+	rows, err := DB.Query(`select "id", "proxy", "country", "asn", "org", "network_type", "city", "subdivision"
+ 							from proxies where deleted = false`)
+	if err != nil {
+		dbLog.Error("Can't find proxies", "err", err)
+		return
+	}
+	var proxies Proxies
+	for rows.Next() {
+		var p Proxy
+		if err := rows.Scan(&p.ID, &p.Proxy, &p.Country, &p.ASN, &p.Org, &p.NetworkType, &p.City, &p.Subdivision); err != nil {
+			dbLog.Error("Can't find proxies", "err", err)
+			break
+		}
+		proxies = append(proxies, &p)
+	}
+	rows.Close()
+	moved := 0
+	for _, p := range proxies {
+		if ctx.Err() != nil {
+			break
+		}
+		before := *p
+		u, err := url.Parse(p.Proxy)
 		if err != nil {
-			return nil, err
+			continue
+		}
+		geo.locate(p, net.ParseIP(u.Hostname()))
+		if p.Country != before.Country || p.ASN != before.ASN || p.Org != before.Org || p.NetworkType != before.NetworkType ||
+			p.City != before.City || p.Subdivision != before.Subdivision {
+			dbStoreLocation(p)
+			moved++
+		}
+	}
+	downloadLog.job().Info("Located proxies again", "proxies", len(proxies), "changed", moved, "duration", time.Since(start))
+}
+
+// Network types of proxies, classified by ASN with the lists in HostingASNFile, MobileASNFile and
+// ResidentialASNFile. Proxies in an ASN that isn't listed have no network type.
+const (
+	NetworkHosting     = "hosting"
+	NetworkResidential = "residential"
+	NetworkMobile      = "mobile"
+)
+
+// networks maps ASNs to their network type. types is nil until the lists are read, and again after they change.
+var networks = struct {
+	sync.Mutex
+	types map[uint]string
+}{}
+
+// networkType classifies asn as hosting, mobile or residential. It's empty when the asn isn't listed.
+func networkType(asn uint) string {
+	networks.Lock()
+	defer networks.Unlock()
+	if networks.types == nil {
+		networks.types = loadNetworks()
+	}
+	return networks.types[asn]
+}
+
+// loadNetworks reads the ASN lists. An ASN on more than one list is hosting before mobile before residential.
+func loadNetworks() map[uint]string {
+	types := map[uint]string{}
+	for _, l := range []struct {
+		network string
+		file    string
+		asns    []uint
+	}{
+		{NetworkResidential, ResidentialASNFile, ResidentialASNs},
+		{NetworkMobile, MobileASNFile, MobileASNs},
+		{NetworkHosting, HostingASNFile, HostingASNs},
+	} {
+		asns := l.asns
+		if l.file != "" {
+			listed, invalid, err := readASNs(l.file)
+			if err != nil && !os.IsNotExist(err) {
+				downloadLog.Warn("Can't read ASN list", "file", l.file, "err", err)
+			}
+			if invalid > 0 {
+				downloadLog.Warn("Skipped invalid ASN list lines", "file", l.file, "lines", invalid)
+			}
+			asns = append(listed, asns...)
+		}
+		for _, asn := range asns {
+			types[asn] = l.network
+		}
+	}
+	return types
+}
+
+// readASNs returns the ASNs in the file f, one per line with or without an AS prefix. Text after # is a comment
+// and anything after the first field of a line is ignored, so lines can name the network. It also returns the
+// number of lines it couldn't parse.
+func readASNs(f string) ([]uint, int, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	var (
+		asns    []uint
+		invalid int
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		field := fields[0]
+		if strings.HasPrefix(strings.ToUpper(field), "AS") {
+			field = field[2:]
 		}
-	} else {
-		M = f
+		n, err := strconv.ParseUint(field, 10, 32)
+		if err != nil || n == 0 {
+			invalid++
+			continue
+		}
+		asns = append(asns, uint(n))
+	}
+	return asns, invalid, scanner.Err()
+}
+
+// reloadNetworks reads the ASN lists again, returning true if they changed.
+func reloadNetworks() bool {
+	types := loadNetworks()
+	networks.Lock()
+	defer networks.Unlock()
+	changed := len(types) != len(networks.types)
+	for asn, t := range types {
+		if networks.types[asn] != t {
+			changed = true
+		}
+	}
+	networks.types = types
+	return changed
+}
+
+// geoDB holds the maxmind dbs used to locate proxies. The asn and city dbs are nil when not configured.
+type geoDB struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+	city    *geoip2.Reader
+	// files are the db paths the readers were opened from.
+	files [3]string
+	// refs counts the users of the readers, which are closed when the last one is done with retired readers.
+	refs    int
+	retired bool
+}
+
+// geoReaders holds the maxmind dbs shared by everything locating proxies, so they're opened once rather than on
+// every request. current is nil until they're first used and after reloadGeo.
+var geoReaders = struct {
+	sync.Mutex
+	current *geoDB
+}{}
+
+// openGeo returns the shared maxmind dbs, opening the ones that exist if they aren't open yet. Dbs that can't be
+// opened are skipped. It never downloads, see fetchMaxmind. Close must be called when done with them.
+func openGeo() *geoDB {
+	files := [3]string{MaxmindFilePath, MaxmindASNFilePath, MaxmindCityFilePath}
+	geoReaders.Lock()
+	defer geoReaders.Unlock()
+	if g := geoReaders.current; g != nil && g.files != files {
+		retireGeo(g)
+		geoReaders.current = nil
+	}
+	if geoReaders.current == nil {
+		geoReaders.current = &geoDB{
+			country: openMaxmind(files[0]),
+			asn:     openMaxmind(files[1]),
+			city:    openMaxmind(files[2]),
+			files:   files,
+		}
+	}
+	geoReaders.current.refs++
+	return geoReaders.current
+}
+
+// reloadGeo has the next openGeo open the dbs again, after they've been updated.
+func reloadGeo() {
+	geoReaders.Lock()
+	defer geoReaders.Unlock()
+	if g := geoReaders.current; g != nil {
+		retireGeo(g)
+		geoReaders.current = nil
+	}
+}
+
+// retireGeo closes g once it isn't in use. geoReaders must be locked.
+func retireGeo(g *geoDB) {
+	g.retired = true
+	if g.refs == 0 {
+		g.closeReaders()
+	}
+}
+
+func openMaxmind(f string) *geoip2.Reader {
+	if f == "" {
+		return nil
 	}
-	db, err := geoip2.Open(M)
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := geoip2.Open(f)
 	if err != nil {
-		return nil, err
+		downloadLog.Warn("Can't open maxmind db", "file", f, "err", err)
+		return nil
+	}
+	return db
+}
+
+// fetchMaxmind downloads the dbs that don't exist yet if they can be downloaded. It's run by jobs before they
+// locate proxies, never by requests.
+func fetchMaxmind(ctx context.Context) {
+	fetched := false
+	for edition, f := range maxmindFiles() {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := updateMaxmind(ctx, edition, f); err != nil {
+			downloadLog.Warn("Can't download maxmind db", "edition", edition, "err", err)
+			continue
+		}
+		fetched = true
+	}
+	if fetched {
+		reloadGeo()
+	}
+}
+
+// locate sets the country, network and city of proxy from its ip. Fields the dbs have nothing for are left as
+// they are.
+func (g *geoDB) locate(proxy *Proxy, ip net.IP) {
+	if g.country != nil {
+		if country, err := g.country.Country(ip); err == nil && country.Country.IsoCode != "" {
+			proxy.Country = country.Country.IsoCode
+		}
 	}
-	return db, nil
+	if g.asn != nil {
+		if asn, err := g.asn.ASN(ip); err == nil && asn.AutonomousSystemNumber != 0 {
+			proxy.ASN = asn.AutonomousSystemNumber
+			proxy.Org = asn.AutonomousSystemOrganization
+			proxy.NetworkType = networkType(proxy.ASN)
+		}
+	}
+	if g.city != nil {
+		if city, err := g.city.City(ip); err == nil && city.City.Names["en"] != "" {
+			proxy.City = city.City.Names["en"]
+			if len(city.Subdivisions) != 0 {
+				proxy.Subdivision = city.Subdivisions[0].Names["en"]
+			}
+			if proxy.Country == "" {
+				proxy.Country = city.Country.IsoCode
+			}
+		}
+	}
+}
 
+// locateExit records exit as the exit ip of proxy and the country it's in. The exit only differs when the
+// proxy's host is an ip, as a hostname may resolve to the exit.
+func (g *geoDB) locateExit(proxy *Proxy, exit string) {
+	proxy.ExitIP = exit
+	proxy.ExitCountry = ""
+	proxy.ExitDiffers = false
+	if exit == "" {
+		return
+	}
+	ip := net.ParseIP(exit)
+	if u, err := url.Parse(proxy.Proxy); err == nil && ip != nil {
+		if host := net.ParseIP(u.Hostname()); host != nil {
+			proxy.ExitDiffers = !host.Equal(ip)
+		}
+	}
+	if ip != nil && g != nil && g.country != nil {
+		if country, err := g.country.Country(ip); err == nil {
+			proxy.ExitCountry = country.Country.IsoCode
+		}
+	}
+}
+
+// Close is done with the dbs from openGeo.
+func (g *geoDB) Close() {
+	geoReaders.Lock()
+	defer geoReaders.Unlock()
+	g.refs--
+	if g.retired && g.refs == 0 {
+		g.closeReaders()
+	}
+}
+
+func (g *geoDB) closeReaders() {
+	for _, db := range []*geoip2.Reader{g.country, g.asn, g.city} {
+		if db != nil {
+			db.Close()
+		}
+	}
 }
@@ -0,0 +1,289 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMmdb returns a maxmind db of dbType with record for the ips in 0.0.0.0/1 and nothing for the rest.
+func testMmdb(dbType string, record map[string]interface{}) []byte {
+	var b bytes.Buffer
+	// one node whose left record points to the start of the data section, which is past the node count and
+	// the 16 byte separator, and whose right record is the node count, meaning no data.
+	b.Write([]byte{0, 0, 17, 0, 0, 1})
+	b.Write(make([]byte, 16))
+	mmdbEncode(&b, record)
+	b.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbEncode(&b, map[string]interface{}{
+		"node_count":                  uint(1),
+		"record_size":                 uint(24),
+		"ip_version":                  uint(4),
+		"database_type":               dbType,
+		"binary_format_major_version": uint(2),
+	})
+	return b.Bytes()
+}
+
+func mmdbEncode(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		if len(v) < 29 {
+			b.WriteByte(2<<5 | byte(len(v)))
+		} else {
+			b.Write([]byte{2<<5 | 29, byte(len(v) - 29)})
+		}
+		b.WriteString(v)
+	case uint:
+		b.WriteByte(6<<5 | 4)
+		binary.Write(b, binary.BigEndian, uint32(v))
+	case map[string]interface{}:
+		b.WriteByte(7<<5 | byte(len(v)))
+		for k, val := range v {
+			mmdbEncode(b, k)
+			mmdbEncode(b, val)
+		}
+	}
+}
+
+func tarGz(name string, data []byte) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+	tw.Write(data)
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func TestUpdateMaxmind(t *testing.T) {
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80"},
+		{Proxy: "http://200.1.1.1:80", Country: "US"},
+	})()
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	files := map[string][]byte{
+		"/country.mmdb":        testMmdb(editionCountry, map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}),
+		"/asn.mmdb":            testMmdb(editionASN, map[string]interface{}{"autonomous_system_number": uint(3320)}),
+		"/GeoLite2-ASN.tar.gz": tarGz("GeoLite2-ASN_20200128/GeoLite2-ASN.mmdb", testMmdb(editionASN, map[string]interface{}{"autonomous_system_number": uint(3320), "autonomous_system_organization": "DTAG"})),
+	}
+	files["/bad.mmdb"] = files["/country.mmdb"]
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/geoip_download" {
+			if r.URL.Query().Get("license_key") != "secret" {
+				http.Error(w, "invalid license key", http.StatusUnauthorized)
+				return
+			}
+			path = "/" + r.URL.Query().Get("edition_id") + "." + r.URL.Query().Get("suffix")
+		}
+		if strings.HasSuffix(path, ".sha256") {
+			name := strings.TrimSuffix(path, ".sha256")
+			b, ok := files[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			sum := fmt.Sprintf("%x", sha256.Sum256(b))
+			if name == "/bad.mmdb" {
+				sum = "00"
+			}
+			fmt.Fprintf(w, "%v  %v\n", sum, filepath.Base(name))
+			return
+		}
+		b, ok := files[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path, modified, bytes.NewReader(b))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "proxi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(url, download string) {
+		MaxmindURL, maxmindDownloadURL = url, download
+		MaxmindFilePath, MaxmindASNFilePath, MaxmindCityFilePath, MaxmindLicenseKey = "", "", "", ""
+	}(MaxmindURL, maxmindDownloadURL)
+	MaxmindFilePath = filepath.Join(dir, "GeoLite2-Country.mmdb")
+	MaxmindASNFilePath = filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	maxmindDownloadURL = srv.URL + "/geoip_download"
+	defer func() {
+		ResidentialASNFile = ""
+		reloadNetworks()
+	}()
+	ResidentialASNFile = filepath.Join(dir, "residential-asns.txt")
+	ioutil.WriteFile(ResidentialASNFile, []byte("AS3320 DTAG\n"), 0644)
+
+	MaxmindURL = srv.URL + "/country.mmdb"
+	if updated, err := updateMaxmind(stopping, editionCountry, MaxmindFilePath); !updated || err != nil {
+		t.Fatalf("updateMaxmind() = %v, %v; want true", updated, err)
+	}
+	if info, err := os.Stat(MaxmindFilePath); err != nil || !info.ModTime().Equal(modified) {
+		t.Fatalf("country db = %v, %v; want modified at %v", info, err, modified)
+	}
+	if updated, err := updateMaxmind(stopping, editionCountry, MaxmindFilePath); updated || err != nil {
+		t.Errorf("updateMaxmind() of an unchanged db = %v, %v; want false", updated, err)
+	}
+
+	// bad downloads leave the db as it was.
+	os.Chtimes(MaxmindFilePath, modified.Add(-time.Hour), modified.Add(-time.Hour))
+	for _, src := range []string{"/bad.mmdb", "/asn.mmdb", "/missing.mmdb"} {
+		MaxmindURL = srv.URL + src
+		if updated, err := updateMaxmind(stopping, editionCountry, MaxmindFilePath); updated || err == nil {
+			t.Errorf("updateMaxmind() from %v = %v, %v; want an error", src, updated, err)
+		}
+	}
+	if b, err := ioutil.ReadFile(MaxmindFilePath); err != nil || !bytes.Equal(b, files["/country.mmdb"]) {
+		t.Errorf("country db changed by a bad download")
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, ".*")); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+
+	// with a license key the asn db is downloaded too, and the proxies are located again.
+	MaxmindLicenseKey = "secret"
+	files["/GeoLite2-Country.tar.gz"] = tarGz("GeoLite2-Country.mmdb", files["/country.mmdb"])
+	refreshMaxmind(context.Background())
+	proxies, err := queryProxies(ProxyFilter{Sort: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := proxies[0]; p.Country != "DE" || p.ASN != 3320 || p.Org != "DTAG" || p.NetworkType != NetworkResidential {
+		t.Errorf("located %+v; want country DE, asn 3320, org DTAG and type residential", p)
+	}
+	if p := proxies[1]; p.Country != "US" || p.ASN != 0 {
+		t.Errorf("located %+v; want country US and no asn", p)
+	}
+
+	MaxmindLicenseKey = "wrong"
+	os.Remove(MaxmindASNFilePath)
+	if updated, err := updateMaxmind(stopping, editionASN, MaxmindASNFilePath); err == nil || strings.Contains(err.Error(), "wrong") {
+		t.Errorf("updateMaxmind() with a bad license key = %v, %v; want an error without the key", updated, err)
+	}
+}
+
+func TestNetworkType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		HostingASNFile, MobileASNFile, ResidentialASNFile, HostingASNs = "", "", "", nil
+		reloadNetworks()
+	}()
+	HostingASNFile = filepath.Join(dir, "hosting.txt")
+	MobileASNFile = filepath.Join(dir, "mobile.txt")
+	ResidentialASNFile = filepath.Join(dir, "missing.txt")
+	HostingASNs = []uint{64500}
+	ioutil.WriteFile(HostingASNFile, []byte("# clouds\nAS16509 Amazon\n13335\nASx\n"), 0644)
+	ioutil.WriteFile(MobileASNFile, []byte("as21928 # T-Mobile US\n13335\n"), 0644)
+	if !reloadNetworks() {
+		t.Error("reloadNetworks() didn't report the lists changed")
+	}
+	for asn, want := range map[uint]string{16509: NetworkHosting, 13335: NetworkHosting, 64500: NetworkHosting,
+		21928: NetworkMobile, 3320: "", 0: ""} {
+		if got := networkType(asn); got != want {
+			t.Errorf("networkType(%d) = %q; want %q", asn, got, want)
+		}
+	}
+	if reloadNetworks() {
+		t.Error("reloadNetworks() reported unchanged lists changed")
+	}
+	if asns, invalid, err := readASNs(HostingASNFile); len(asns) != 2 || invalid != 1 || err != nil {
+		t.Errorf("readASNs() = %v, %d, %v; want 2 asns and 1 invalid line", asns, invalid, err)
+	}
+}
+
+func TestLocateExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "GeoLite2-Country.mmdb")
+	ioutil.WriteFile(f, testMmdb(editionCountry, map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}), 0644)
+	defer func() { MaxmindFilePath = "" }()
+	MaxmindFilePath = f
+	geo := openGeo()
+	defer geo.Close()
+
+	defer func(ip string) { realIP = ip }(realIP)
+	realIP = "203.0.113.1"
+	tests := []struct {
+		origin  string
+		exit    string
+		country string
+		differs bool
+	}{
+		{"1.1.1.1", "1.1.1.1", "DE", false},
+		{"2.2.2.2", "2.2.2.2", "DE", true},
+		// a transparent proxy adds our ip in X-Forwarded-For.
+		{"203.0.113.1, 200.1.1.1", "200.1.1.1", "", true},
+		{"203.0.113.1", "", "", false},
+	}
+	for _, tt := range tests {
+		p := &Proxy{Proxy: "http://1.1.1.1:80", ExitCountry: "US"}
+		geo.locateExit(p, exitIP(tt.origin))
+		if p.ExitIP != tt.exit || p.ExitCountry != tt.country || p.ExitDiffers != tt.differs {
+			t.Errorf("origin %q: exit %q in %q differs %v; want %q in %q differs %v", tt.origin, p.ExitIP, p.ExitCountry,
+				p.ExitDiffers, tt.exit, tt.country, tt.differs)
+		}
+	}
+	// a hostname may resolve to the exit, so it isn't compared.
+	p := &Proxy{Proxy: "http://proxy.example.com:80"}
+	geo.locateExit(p, "2.2.2.2")
+	if p.ExitIP != "2.2.2.2" || p.ExitDiffers {
+		t.Errorf("proxy with a hostname: exit %q differs %v; want 2.2.2.2 not differing", p.ExitIP, p.ExitDiffers)
+	}
+
+	// the dbs are shared until they're reloaded.
+	shared := openGeo()
+	if shared != geo {
+		t.Error("openGeo opened the dbs again")
+	}
+	shared.Close()
+	reloadGeo()
+	reopened := openGeo()
+	defer reopened.Close()
+	if reopened == geo || reopened.country == nil {
+		t.Error("openGeo didn't open the dbs again after reloadGeo")
+	}
+	if geo.locateExit(p, "1.1.1.1"); p.ExitCountry != "DE" {
+		t.Errorf("retired dbs closed while in use, exit country %q", p.ExitCountry)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "proxi"
+
+var (
+	checksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checks_total",
+		Help:      "Number of proxy checks by resulting status.",
+	}, []string{"status"})
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "check_duration_seconds",
+		Help:      "Duration of proxy checks by resulting status.",
+		Buckets:   []float64{.25, .5, 1, 2, 5, 10, 20, 30, 60},
+	}, []string{"status"})
+	checkCycleDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "check_cycle_duration_seconds",
+		Help:      "Duration of check cycles over all proxies.",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 8),
+	})
+	checkCycleLast = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "check_cycle_last_completed_timestamp_seconds",
+		Help:      "Unix time the last check cycle completed.",
+	})
+	downloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_duration_seconds",
+		Help:      "Duration of downloading proxies from all providers.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 8),
+	})
+	providerFound = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_proxies_total",
+		Help:      "Number of proxies returned by each provider.",
+	}, []string{"provider"})
+	providerFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_fetches_total",
+		Help:      "Number of times each provider was fetched.",
+	}, []string{"provider"})
+	providerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_fetch_errors_total",
+		Help:      "Number of provider fetches that timed out or returned no proxies.",
+	}, []string{"provider", "reason"})
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_fetch_duration_seconds",
+		Help:      "Duration of provider fetches.",
+		Buckets:   prometheus.ExponentialBuckets(.5, 2, 9),
+	}, []string{"provider"})
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of api requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of api requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(poolCollector{})
+}
+
+// observeCheck records the outcome of a proxy check. Proxies deleted without a request are only counted.
+func observeCheck(proxy *Proxy, d time.Duration) {
+	if proxy.Deleted {
+		checksTotal.WithLabelValues("deleted").Inc()
+		return
+	}
+	checksTotal.WithLabelValues(proxy.LastStatus).Inc()
+	checkDuration.WithLabelValues(proxy.LastStatus).Observe(d.Seconds())
+}
+
+func observeCheckCycle(d time.Duration) {
+	checkCycleDuration.Observe(d.Seconds())
+	checkCycleLast.SetToCurrentTime()
+}
+
+func observeProviderFetch(name string, found int, ctxErr error, d time.Duration) {
+	providerFetches.WithLabelValues(name).Inc()
+	providerFound.WithLabelValues(name).Add(float64(found))
+	providerDuration.WithLabelValues(name).Observe(d.Seconds())
+	switch {
+	case ctxErr == context.DeadlineExceeded:
+		providerErrors.WithLabelValues(name, "timeout").Inc()
+	case found == 0:
+		providerErrors.WithLabelValues(name, "empty").Inc()
+	}
+}
+
+// httpMetrics is middleware recording api request counts and durations by route.
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// poolCollector queries the db on each scrape for the proxy pool and db connection pool gauges.
+type poolCollector struct{}
+
+var (
+	poolProxiesDesc = prometheus.NewDesc(metricsNamespace+"_pool_proxies",
+		"Number of proxies in the pool by last status, country and anonymity.",
+		[]string{"status", "country", "anonymous"}, nil)
+	poolDeletedDesc = prometheus.NewDesc(metricsNamespace+"_pool_deleted_proxies",
+		"Number of proxies marked deleted.", nil, nil)
+	dbOpenDesc = prometheus.NewDesc(metricsNamespace+"_db_open_connections",
+		"Number of established db connections, in use and idle.", nil, nil)
+	dbInUseDesc = prometheus.NewDesc(metricsNamespace+"_db_in_use_connections",
+		"Number of db connections currently in use.", nil, nil)
+	dbIdleDesc = prometheus.NewDesc(metricsNamespace+"_db_idle_connections",
+		"Number of idle db connections.", nil, nil)
+	dbMaxOpenDesc = prometheus.NewDesc(metricsNamespace+"_db_max_open_connections",
+		"Maximum number of open db connections.", nil, nil)
+	dbWaitCountDesc = prometheus.NewDesc(metricsNamespace+"_db_wait_count_total",
+		"Number of times a db connection was waited for.", nil, nil)
+	dbWaitDurationDesc = prometheus.NewDesc(metricsNamespace+"_db_wait_duration_seconds_total",
+		"Total time spent waiting for a db connection.", nil, nil)
+)
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolProxiesDesc
+	ch <- poolDeletedDesc
+	ch <- dbOpenDesc
+	ch <- dbInUseDesc
+	ch <- dbIdleDesc
+	ch <- dbMaxOpenDesc
+	ch <- dbWaitCountDesc
+	ch <- dbWaitDurationDesc
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	if DB == nil {
+		return
+	}
+	s := DB.Stats()
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDurationDesc, prometheus.CounterValue, s.WaitDuration.Seconds())
+
+	// like getStats, don't wait on sqlite's single connection while the checker is writing.
+	if connectionLimit == 1 && s.InUse == s.MaxOpenConnections {
+		return
+	}
+	rows, err := DB.Query(`select "last_status", "country", "anonymous", count(*) from proxies
+ 							where deleted = false group by last_status, country, anonymous`)
+	if err != nil {
+		metricsLog.Error("Can't count proxies", "err", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			status, country string
+			anon            bool
+			n               float64
+		)
+		if err := rows.Scan(&status, &country, &anon, &n); err != nil {
+			metricsLog.Error("Can't count proxies", "err", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(poolProxiesDesc, prometheus.GaugeValue, n, status, country, strconv.FormatBool(anon))
+	}
+
+	var deleted float64
+	if err := DB.QueryRow(`select count(*) from proxies where deleted = true`).Scan(&deleted); err != nil {
+		metricsLog.Error("Can't count deleted proxies", "err", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(poolDeletedDesc, prometheus.GaugeValue, deleted)
+}
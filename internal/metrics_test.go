@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetrics(t *testing.T) {
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", Country: "US", LastStatus: "good", Anonymous: true},
+		{Proxy: "http://2.2.2.2:80", Country: "US", LastStatus: "good", Anonymous: true},
+		{Proxy: "http://3.3.3.3:80", Country: "DE", LastStatus: "timeout"},
+	})()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(httpMetrics())
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, want := range []string{
+		`proxi_pool_proxies{anonymous="true",country="US",status="good"} 2`,
+		`proxi_pool_proxies{anonymous="false",country="DE",status="timeout"} 1`,
+		`proxi_http_requests_total{code="200",method="GET",route="/metrics"} 1`,
+		`proxi_db_max_open_connections 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics missing %v", want)
+		}
+	}
+}
@@ -22,13 +22,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -41,7 +39,6 @@ var (
 
 func freeproxylistsP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -98,14 +95,8 @@ func freeproxylistsP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -113,7 +104,6 @@ func freeproxylistsP(ctx context.Context) Proxies {
 
 func webanetlabsP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -161,14 +151,8 @@ func webanetlabsP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -177,7 +161,6 @@ func webanetlabsP(ctx context.Context) Proxies {
 func checkerproxyP(ctx context.Context) Proxies {
 
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -231,14 +214,8 @@ func checkerproxyP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -246,7 +223,6 @@ func checkerproxyP(ctx context.Context) Proxies {
 
 func proxyListP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -271,7 +247,9 @@ func proxyListP(ctx context.Context) Proxies {
 						continue
 					}
 					decoded, err := base64.StdEncoding.DecodeString(match)
-					check(err)
+					if err != nil {
+						continue
+					}
 					proxy := fmt.Sprintf("http://%v", string(decoded))
 					p := Proxy{Proxy: proxy, Source: source}
 					mu.Lock()
@@ -290,22 +268,15 @@ func proxyListP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
 			return foundProxies
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 		}
 	}
 }
 
 func aliveproxyP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -364,14 +335,8 @@ func aliveproxyP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -379,7 +344,6 @@ func aliveproxyP(ctx context.Context) Proxies {
 
 func feiyiproxyP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -407,14 +371,8 @@ func feiyiproxyP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -423,7 +381,6 @@ func feiyiproxyP(ctx context.Context) Proxies {
 
 func yipP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		largest      int
 		foundProxies Proxies
@@ -483,14 +440,8 @@ func yipP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -498,7 +449,6 @@ func yipP(ctx context.Context) Proxies {
 
 func ip3366P(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		largest      int
 		foundProxies Proxies
@@ -558,21 +508,14 @@ func ip3366P(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
 }
 
 func kuaidailiP(ctx context.Context) Proxies {
-	start := time.Now()
 	var (
 		largest      int
 		foundProxies Proxies
@@ -639,14 +582,8 @@ func kuaidailiP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -654,7 +591,6 @@ func kuaidailiP(ctx context.Context) Proxies {
 
 func proxylistMeP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		largest      int
 		foundProxies Proxies
@@ -724,14 +660,8 @@ func proxylistMeP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -739,7 +669,6 @@ func proxylistMeP(ctx context.Context) Proxies {
 
 func proxylistDownloadP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -776,14 +705,8 @@ func proxylistDownloadP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -791,7 +714,6 @@ func proxylistDownloadP(ctx context.Context) Proxies {
 
 func usProxyP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -819,14 +741,8 @@ func usProxyP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -834,7 +750,6 @@ func usProxyP(ctx context.Context) Proxies {
 
 func blogspotP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -893,14 +808,8 @@ func blogspotP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -908,7 +817,6 @@ func blogspotP(ctx context.Context) Proxies {
 
 func proxP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -954,14 +862,8 @@ func proxP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -969,7 +871,6 @@ func proxP(ctx context.Context) Proxies {
 
 func myProxyP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -1014,14 +915,8 @@ func myProxyP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -1029,7 +924,6 @@ func myProxyP(ctx context.Context) Proxies {
 
 func xseoP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -1059,14 +953,8 @@ func xseoP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -1074,7 +962,6 @@ func xseoP(ctx context.Context) Proxies {
 
 func githubClarketmP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -1103,14 +990,8 @@ func githubClarketmP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -1118,7 +999,6 @@ func githubClarketmP(ctx context.Context) Proxies {
 
 func githubTheSpeedP(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -1147,14 +1027,8 @@ func githubTheSpeedP(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
@@ -1162,7 +1036,6 @@ func githubTheSpeedP(ctx context.Context) Proxies {
 
 func githubSunny9577(ctx context.Context) Proxies {
 	defer ctx.Done()
-	start := time.Now()
 	var (
 		foundProxies Proxies
 		mu           sync.Mutex
@@ -1191,14 +1064,8 @@ func githubSunny9577(ctx context.Context) Proxies {
 			mu.Lock()
 			foundP := foundProxies
 			mu.Unlock()
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundP))
-			}
 			return foundP
 		case <-done:
-			if os.Getenv("PROXI_PROVIDER_DEBUG") == "1" {
-				fmt.Printf("\n%v\t%v\t%v\n", time.Since(start), source, len(foundProxies))
-			}
 			return foundProxies
 		}
 	}
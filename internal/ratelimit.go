@@ -0,0 +1,270 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+const ctxHandedOut = "handed_out"
+
+var (
+	// maxTrackedClients is the most clients tracked at once. Usage from previous days is pruned first,
+	// then the least recently seen clients.
+	maxTrackedClients = 10000
+	// RateLimit is the default number of /get requests per second allowed per client. 0 disables it.
+	RateLimit float64
+	// RateBurst is the number of /get requests a client can make at once before RateLimit applies.
+	RateBurst int
+	// DailyQuota is the default number of proxies handed out per client per day (UTC). 0 disables it.
+	DailyQuota int64
+	// TrustedProxies are the CIDRs or ips of reverse proxies whose X-Forwarded-For and X-Real-Ip headers
+	// are used for the client ip. The headers are ignored when it's empty.
+	TrustedProxies []string
+	trustedNets    []*net.IPNet
+	usage          = struct {
+		sync.Mutex
+		clients map[string]*clientUsage
+	}{clients: make(map[string]*clientUsage)}
+)
+
+// clientUsage tracks the rate limiter and usage counters of an api key or ip.
+type clientUsage struct {
+	Client       string  `json:"client"`
+	Day          string  `json:"day"`
+	Requests     int64   `json:"requests_today"`
+	Limited      int64   `json:"limited_today"`
+	Proxies      int64   `json:"proxies_today"`
+	TotalProxies int64   `json:"proxies_total"`
+	RateLimit    float64 `json:"rate_limit"`
+	DailyQuota   int64   `json:"daily_quota"`
+	limiter      *rate.Limiter
+	lastSeen     time.Time
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// untilTomorrow returns the duration until quotas reset at the next UTC midnight.
+func untilTomorrow() time.Duration {
+	now := time.Now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+// requestClient identifies the client by api key if one was used, otherwise by ip.
+// It also returns the rate limit and quota that apply to the client.
+func requestClient(c *gin.Context) (string, float64, int64) {
+	if v, ok := c.Get(ctxAPIKey); ok {
+		k := v.(*APIKey)
+		limit, quota := RateLimit, DailyQuota
+		if k.RateLimit != 0 {
+			limit = k.RateLimit
+		}
+		if k.DailyQuota != 0 {
+			quota = k.DailyQuota
+		}
+		return "key:" + k.Prefix, limit, quota
+	}
+	return "ip:" + clientIP(c.Request), RateLimit, DailyQuota
+}
+
+// ParseTrustedProxies parses TrustedProxies, which must be done before the api starts.
+func ParseTrustedProxies() error {
+	trustedNets = nil
+	for _, s := range TrustedProxies {
+		n, err := parseNet(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		trustedNets = append(trustedNets, n)
+	}
+	return nil
+}
+
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range trustedNets {
+		if addr != nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip req came from. The forwarded headers are only used when the request came through a
+// trusted proxy, and X-Forwarded-For is read from the right so entries the client added itself are skipped.
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(req.Header.Get("X-Real-Ip")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// getUsage returns the usage for client, resetting the daily counters when the day changes. usage must be locked.
+func getUsage(client string, limit float64, quota int64) *clientUsage {
+	day := today()
+	u, ok := usage.clients[client]
+	if !ok {
+		if len(usage.clients) >= maxTrackedClients {
+			for k, v := range usage.clients {
+				if v.Day != day {
+					delete(usage.clients, k)
+				}
+			}
+		}
+		for len(usage.clients) >= maxTrackedClients {
+			var oldest *clientUsage
+			for _, v := range usage.clients {
+				if oldest == nil || v.lastSeen.Before(oldest.lastSeen) {
+					oldest = v
+				}
+			}
+			delete(usage.clients, oldest.Client)
+		}
+		u = &clientUsage{Client: client, Day: day}
+		usage.clients[client] = u
+	}
+	u.lastSeen = time.Now()
+	if u.Day != day {
+		u.Day = day
+		u.Requests, u.Limited, u.Proxies = 0, 0, 0
+	}
+	if u.limiter == nil || u.RateLimit != limit {
+		burst := RateBurst
+		if burst < 1 {
+			burst = int(math.Max(1, math.Ceil(limit)))
+		}
+		u.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+		if limit <= 0 {
+			u.limiter.SetLimit(rate.Inf)
+		}
+	}
+	u.RateLimit, u.DailyQuota = limit, quota
+	return u
+}
+
+func tooManyRequests(c *gin.Context, retry time.Duration, msg string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": msg})
+}
+
+// rateLimit is middleware for the proxy handing routes that applies the per client rate limit and daily quota.
+// count returns the most proxies the request can hand out, which are reserved from the quota up front so
+// concurrent requests can't overrun it. Handlers set ctxHandedOut to the number of proxies actually returned
+// and the rest of the reservation is refunded.
+func rateLimit(count func(*gin.Context) (int64, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, err := count(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		client, limit, quota := requestClient(c)
+
+		usage.Lock()
+		u := getUsage(client, limit, quota)
+		u.Requests++
+		r := u.limiter.Reserve()
+		if delay := r.Delay(); delay > 0 {
+			r.Cancel()
+			u.Limited++
+			usage.Unlock()
+			tooManyRequests(c, delay, fmt.Sprintf("rate limit of %v requests per second exceeded", limit))
+			return
+		}
+		if quota > 0 && u.Proxies+n > quota {
+			u.Limited++
+			remaining := quota - u.Proxies
+			usage.Unlock()
+			tooManyRequests(c, untilTomorrow(), fmt.Sprintf("daily quota of %v proxies exceeded, %v remaining", quota, remaining))
+			return
+		}
+		day := u.Day
+		u.Proxies += n
+		usage.Unlock()
+
+		c.Next()
+
+		handed := int64(c.GetInt(ctxHandedOut))
+		usage.Lock()
+		if u.Day == day {
+			u.Proxies -= n - handed
+		}
+		u.TotalProxies += handed
+		usage.Unlock()
+	}
+}
+
+// getUsageStats returns the usage of every client, or only the requesting client unless auth is
+// disabled or the request was made with an admin key.
+func getUsageStats(c *gin.Context) []clientUsage {
+	all := !AuthEnabled
+	if v, ok := c.Get(ctxAPIKey); ok && v.(*APIKey).Role == RoleAdmin {
+		all = true
+	}
+	client, limit, quota := requestClient(c)
+
+	usage.Lock()
+	defer usage.Unlock()
+	var out []clientUsage
+	if !all {
+		return append(out, *getUsage(client, limit, quota))
+	}
+	for _, u := range usage.clients {
+		if u.Day != today() {
+			continue
+		}
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Client < out[j].Client
+	})
+	return out
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	RateLimit, RateBurst, DailyQuota = 1, 2, 5
+	defer func() { RateLimit, RateBurst, DailyQuota = 0, 0, 0 }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handler := func(c *gin.Context) {
+		n, _ := strconv.Atoi(c.Param("n"))
+		if n == 0 {
+			n = 1
+		}
+		c.Set(ctxHandedOut, n)
+		c.String(http.StatusOK, "ok")
+	}
+	r.GET("/get", rateLimit(oneProxy), handler)
+	r.GET("/get/:n", rateLimit(proxyCount), handler)
+	r.GET("/none/:n", rateLimit(proxyCount), func(c *gin.Context) {
+		c.Set(ctxHandedOut, 0)
+		c.String(http.StatusOK, "ok")
+	})
+
+	do := func(path, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// burst of 2 then limited
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if w := do("/get", "10.0.0.1"); w.Code != want {
+			t.Errorf("request %d = %d; want %d", i, w.Code, want)
+		} else if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("429 response missing Retry-After")
+		}
+	}
+
+	// invalid counts are rejected before they touch the quota
+	for _, path := range []string{"/get/0", "/get/-3", "/get/x"} {
+		if w := do(path, "10.0.0.2"); w.Code != http.StatusBadRequest {
+			t.Errorf("%v = %d; want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// the unused part of a reservation is refunded
+	if w := do("/none/5", "10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("/none/5 = %d; want %d", w.Code, http.StatusOK)
+	}
+	time.Sleep(time.Second)
+
+	// other clients aren't affected, and quotas count proxies rather than requests
+	if w := do("/get/4", "10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("/get/4 = %d; want %d", w.Code, http.StatusOK)
+	}
+	if w := do("/get/2", "10.0.0.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("/get/2 over quota = %d; want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	usage.Lock()
+	u := usage.clients["ip:10.0.0.2"]
+	usage.Unlock()
+	if u == nil || u.Proxies != 4 || u.TotalProxies != 4 || u.Limited != 1 {
+		t.Errorf("usage for 10.0.0.2 = %+v; want 4 proxies and 1 limited", u)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	if err := ParseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { TrustedProxies, trustedNets = nil, nil }()
+
+	for _, tt := range []struct {
+		remote, fwd, real, want string
+	}{
+		{"203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.1, 192.168.1.1", "", "198.51.100.1"},
+		{"10.1.2.3:1234", "junk, 198.51.100.1", "", "198.51.100.1"},
+		{"192.168.1.1:1234", "", "198.51.100.2", "198.51.100.2"},
+	} {
+		req := httptest.NewRequest("GET", "/get", nil)
+		req.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			req.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		if tt.real != "" {
+			req.Header.Set("X-Real-Ip", tt.real)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%v, %q, %q) = %v; want %v", tt.remote, tt.fwd, tt.real, got, tt.want)
+		}
+	}
+
+	TrustedProxies = []string{"not an ip"}
+	if err := ParseTrustedProxies(); err == nil {
+		t.Error("ParseTrustedProxies accepted an invalid ip")
+	}
+}
+
+func TestUsageCap(t *testing.T) {
+	defer func(n int) {
+		maxTrackedClients = n
+		usage.Lock()
+		usage.clients = make(map[string]*clientUsage)
+		usage.Unlock()
+	}(maxTrackedClients)
+	maxTrackedClients = 3
+
+	usage.Lock()
+	defer usage.Unlock()
+	usage.clients = make(map[string]*clientUsage)
+	for _, client := range []string{"ip:a", "ip:b", "ip:c"} {
+		getUsage(client, 0, 0)
+		time.Sleep(time.Millisecond)
+	}
+	getUsage("ip:a", 0, 0)
+	getUsage("ip:d", 0, 0)
+	if len(usage.clients) != 3 {
+		t.Errorf("tracking %d clients; want 3", len(usage.clients))
+	}
+	if usage.clients["ip:b"] != nil {
+		t.Error("least recently seen client ip:b wasn't evicted")
+	}
+	for _, client := range []string{"ip:a", "ip:c", "ip:d"} {
+		if usage.clients[client] == nil {
+			t.Errorf("client %v was evicted", client)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scheduled jobs.
+const (
+	// JobDownload downloads proxies and checks the new ones.
+	JobDownload = "download"
+	// JobCheckGood re-checks good proxies.
+	JobCheckGood = "check_good"
+	// JobCheckBad re-checks proxies that failed or timed out.
+	JobCheckBad = "check_bad"
+	// JobMaxmind updates the maxmind dbs and locates proxies again if they changed.
+	JobMaxmind = "maxmind"
+	// JobBlocklists reloads the blocklists and tags the proxies on them.
+	JobBlocklists = "blocklists"
+)
+
+// Unscheduled jobs, named in logs.
+const (
+	// JobCheckAll checks every proxy, for proxi server --check.
+	JobCheckAll = "check_all"
+	// JobContinuous is a batch of checks in continuous mode.
+	JobContinuous    = "continuous"
+	jobResolveJudges = "resolve_judges"
+)
+
+var (
+	jobNames  = []string{JobDownload, JobCheckGood, JobCheckBad, JobMaxmind, JobBlocklists}
+	scheduler = struct {
+		sync.Mutex
+		jobs    map[string]*Job
+		running string
+	}{jobs: make(map[string]*Job)}
+)
+
+// Job is a scheduled job and when it runs next. Jobs are stored in the db so missed runs happen after a restart.
+type Job struct {
+	Name     string     `json:"name" gorm:"primary_key"`
+	Schedule string     `json:"schedule"`
+	NextRun  time.Time  `json:"next_run"`
+	LastRun  *time.Time `json:"last_run"`
+	Running  bool       `json:"running" gorm:"-"`
+}
+
+// Schedule runs each job when it's due. Jobs run one at a time, waiting for any download or check already running.
+func Schedule() {
+	// schedules are set at startup, so a change before now doesn't need a wake up.
+	select {
+	case <-settings.scheduleChanged:
+	default:
+	}
+	for {
+		// another replica may have run jobs while this one followed, so reload them on every election.
+		lead := WaitLeader()
+		if judgeUrl == "" {
+			// resolve a judge before the first job so /readyz can report it.
+			if !startJob(jobResolveJudges) {
+				return
+			}
+			ctx, cancel := jobContext(lead)
+			if err := resolveJudges(ctx); err != nil && ctx.Err() == nil {
+				checkLog.Error("Can't resolve a judge", "err", err)
+			}
+			cancel()
+			finishJob()
+		}
+		loadJobs()
+		runSchedule(lead)
+		if stopping.Err() != nil {
+			return
+		}
+	}
+}
+
+// runSchedule runs jobs as they fall due until lead is canceled or the server shuts down.
+func runSchedule(lead context.Context) {
+	for {
+		job := nextJob()
+		if job == nil {
+			select {
+			case <-settings.scheduleChanged:
+				continue
+			case <-lead.Done():
+				return
+			case <-stopping.Done():
+				return
+			}
+		}
+		scheduleLog.Info("Next job scheduled", "job", job.Name, "at", job.NextRun)
+		select {
+		case <-time.After(time.Until(job.NextRun)):
+			runJob(lead, job.Name)
+		case <-settings.scheduleChanged:
+		case <-lead.Done():
+			return
+		case <-stopping.Done():
+			return
+		}
+	}
+}
+
+func loadJobs() {
+	rows, err := DB.Query(`select "name", "schedule", "next_run", "last_run" from jobs`)
+	if err != nil {
+		scheduleLog.Error("Can't load jobs", "err", err)
+		return
+	}
+	defer rows.Close()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.Name, &j.Schedule, &j.NextRun, &j.LastRun); err != nil {
+			scheduleLog.Error("Can't load jobs", "err", err)
+			return
+		}
+		scheduler.jobs[j.Name] = &j
+	}
+}
+
+func saveJob(j *Job) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, err := DB.Exec(`insert into jobs("name", "schedule", "next_run", "last_run") values($1,$2,$3,$4)
+							on conflict (name) do update set schedule = excluded.schedule, next_run = excluded.next_run,
+							last_run = excluded.last_run`, j.Name, j.Schedule, j.NextRun, j.LastRun)
+	if err != nil {
+		scheduleLog.Error("Can't save job", "job", j.Name, "err", err)
+	}
+}
+
+// nextJob updates the next run of jobs whose schedule changed and returns a copy of the one due first.
+func nextJob() *Job {
+	settings.Lock()
+	current := settings.current
+	settings.Unlock()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	var next *Job
+	for _, name := range jobNames {
+		if Continuous && (name == JobCheckGood || name == JobCheckBad) {
+			// CheckContinuously re-checks proxies instead.
+			delete(scheduler.jobs, name)
+			continue
+		}
+		expr := current.schedule(name)
+		j := scheduler.jobs[name]
+		if j == nil {
+			j = &Job{Name: name}
+			scheduler.jobs[name] = j
+		}
+		if j.Schedule != expr || j.NextRun.IsZero() {
+			spec, err := parseCron(expr)
+			if err != nil {
+				scheduleLog.Error("Invalid schedule", "job", name, "err", err)
+				continue
+			}
+			j.Schedule = expr
+			j.NextRun = spec.next(time.Now())
+			saveJob(j)
+		}
+		if next == nil || j.NextRun.Before(next.NextRun) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	j := *next
+	return &j
+}
+
+func runJob(lead context.Context, name string) {
+	if !startJob(name) {
+		return
+	}
+	defer finishJob()
+	ctx, cancel := jobContext(lead)
+	defer cancel()
+	start := time.Now()
+	scheduler.Lock()
+	scheduler.running = name
+	scheduler.Unlock()
+	switch name {
+	case JobDownload:
+		storeDownloads(ctx)
+		checkProxies(ctx, dbFind(checkUnchecked))
+	case JobCheckGood:
+		checkProxies(ctx, dbFind(checkGood))
+	case JobCheckBad:
+		checkProxies(ctx, dbFind(checkBad))
+	case JobMaxmind:
+		refreshMaxmind(ctx)
+	case JobBlocklists:
+		refreshBlocklists(ctx)
+	}
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	scheduler.running = ""
+	if ctx.Err() != nil {
+		// it was cut short by shutdown or lost leadership, so leave it due to run again.
+		return
+	}
+	j := scheduler.jobs[name]
+	j.LastRun = &start
+	if spec, err := parseCron(j.Schedule); err == nil {
+		j.NextRun = spec.next(time.Now())
+	}
+	saveJob(j)
+}
+
+// getSchedule is the handler listing the jobs in the order they run next.
+func getSchedule(c *gin.Context) {
+	scheduler.Lock()
+	jobs := make([]*Job, 0, len(scheduler.jobs))
+	for _, j := range scheduler.jobs {
+		job := *j
+		job.Running = j.Name == scheduler.running
+		jobs = append(jobs, &job)
+	}
+	scheduler.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].NextRun.Before(jobs[k].NextRun) })
+	c.IndentedJSON(http.StatusOK, jobs)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2020, 1, 31, 10, 30, 15, 0, time.UTC) // a friday
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2020, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2020, 2, 1, 3, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"30 10,22 * * 7", time.Date(2020, 2, 2, 10, 30, 0, 0, time.UTC)},
+		// either day field matches when both are set.
+		{"0 0 15 * 6", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", from.Add(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := spec.next(from); !got.Equal(tt.next) {
+			t.Errorf("%q next = %v, want %v", tt.expr, got, tt.next)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "0 0 30 2 *", "@every 1s", "@sometimes"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) returned no error", expr)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	good, bad := "good", "fail"
+	defer testDB(t, Proxies{
+		{Proxy: "http://127.0.0.1:1", LastStatus: good},
+		{Proxy: "http://127.0.0.1:2", LastStatus: bad},
+		{Proxy: "http://127.0.0.1:3", LastStatus: bad},
+	})()
+	for where, want := range map[string]int{checkAll: 3, checkGood: 1, checkBad: 2, checkUnchecked: 0} {
+		if n := len(dbFind(where)); n != want {
+			t.Errorf("dbFind(%q) found %d proxies, want %d", where, n, want)
+		}
+	}
+
+	// the maxmind and blocklist refreshes are pushed out so check_good is always due first.
+	settings := Settings{Interval: time.Hour, CheckGoodSchedule: "@every 30m", MaxmindSchedule: "@every 24h", BlocklistSchedule: "@every 24h"}
+	ApplySettings(settings)
+	defer ApplySettings(Settings{})
+	scheduler.jobs = make(map[string]*Job)
+	next := nextJob()
+	if next.Name != JobCheckGood || time.Until(next.NextRun) > 30*time.Minute {
+		t.Fatalf("next job %v at %v, want %v within 30m", next.Name, next.NextRun, JobCheckGood)
+	}
+
+	// next runs are kept over restarts unless the schedule changes.
+	scheduler.jobs = make(map[string]*Job)
+	loadJobs()
+	if len(scheduler.jobs) != len(jobNames) {
+		t.Fatalf("loaded %d jobs, want %d", len(scheduler.jobs), len(jobNames))
+	}
+	if j := scheduler.jobs[JobCheckGood]; !j.NextRun.Equal(next.NextRun) || j.Schedule != "@every 30m" {
+		t.Errorf("loaded %+v, want next run %v", j, next.NextRun)
+	}
+	download := scheduler.jobs[JobDownload].NextRun
+	settings.Interval = 2 * time.Hour
+	ApplySettings(settings)
+	nextJob()
+	if j := scheduler.jobs[JobDownload]; j.NextRun.Sub(download) < 59*time.Minute || j.Schedule != "@every 2h0m0s" {
+		t.Errorf("download job %+v wasn't rescheduled from %v", j, download)
+	}
+	if j := scheduler.jobs[JobCheckGood]; !j.NextRun.Equal(next.NextRun) {
+		t.Errorf("unchanged check_good job moved to %v", j.NextRun)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// DisabledProviders are the names of providers skipped when downloading.
+	DisabledProviders []string
+	// Reload re-reads the config file and applies the settings that can change while running. It returns true
+	// if they were applied now rather than after the running download or check. Set by the server command.
+	Reload func() (bool, error)
+
+	settings = struct {
+		sync.Mutex
+		current Settings
+		pending *Settings
+		// scheduleChanged wakes the scheduler to recompute the next runs.
+		scheduleChanged chan struct{}
+		// job is held while a download or check runs so they run one at a time.
+		job sync.Mutex
+		// jobID identifies the running job in logs.
+		jobID string
+	}{scheduleChanged: make(chan struct{}, 1)}
+)
+
+// Settings are the settings that can change while the server is running.
+type Settings struct {
+	Workers           int
+	Timeout           time.Duration
+	DownloadTimeout   time.Duration
+	Judges            []string
+	DisabledProviders []string
+	// RecheckMin and RecheckMax bound the wait between checks of a proxy in continuous mode.
+	RecheckMin time.Duration
+	RecheckMax time.Duration
+	// Interval is the wait between runs of jobs without a schedule.
+	Interval time.Duration
+	// DownloadSchedule, CheckGoodSchedule and CheckBadSchedule are cron expressions for the jobs.
+	DownloadSchedule  string
+	CheckGoodSchedule string
+	CheckBadSchedule  string
+	// MaxmindSchedule is the cron expression for updating the maxmind dbs, weekly by default.
+	MaxmindSchedule string
+	// BlocklistSchedule is the cron expression for reloading the blocklists, hourly by default.
+	BlocklistSchedule string
+	Blocklists        []string
+	Allow             []string
+	Deny              []string
+}
+
+// schedule returns the cron expression for job.
+func (s Settings) schedule(job string) string {
+	var expr string
+	switch job {
+	case JobDownload:
+		expr = s.DownloadSchedule
+	case JobCheckGood:
+		expr = s.CheckGoodSchedule
+	case JobCheckBad:
+		expr = s.CheckBadSchedule
+	case JobMaxmind:
+		if s.MaxmindSchedule == "" {
+			return "@weekly"
+		}
+		expr = s.MaxmindSchedule
+	case JobBlocklists:
+		if s.BlocklistSchedule == "" {
+			return "@hourly"
+		}
+		expr = s.BlocklistSchedule
+	}
+	if expr == "" {
+		expr = "@every " + s.Interval.String()
+	}
+	return expr
+}
+
+// Validate checks that s can be applied.
+func (s Settings) Validate() error {
+	switch {
+	case s.Workers < 1:
+		return fmt.Errorf("workers must be at least 1, got %d", s.Workers)
+	case s.Timeout <= 0:
+		return fmt.Errorf("check_timeout must be positive, got %v", s.Timeout)
+	case s.DownloadTimeout <= 0:
+		return fmt.Errorf("download_timeout must be positive, got %v", s.DownloadTimeout)
+	case s.RecheckMin <= 0:
+		return fmt.Errorf("recheck_min must be positive, got %v", s.RecheckMin)
+	case s.RecheckMax < s.RecheckMin:
+		return fmt.Errorf("recheck_max must be at least recheck_min, got %v", s.RecheckMax)
+	case s.Interval < time.Hour:
+		return fmt.Errorf("interval must be at least 1 hour, got %v", s.Interval)
+	}
+	for _, j := range s.Judges {
+		u, err := url.Parse(strings.TrimSpace(j))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("judges: invalid url %q", j)
+		}
+	}
+	for _, name := range s.DisabledProviders {
+		if !providerExists(name) {
+			return fmt.Errorf("disable_providers: unknown provider %q", name)
+		}
+	}
+	if err := validateRules(s.Allow); err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	if err := validateRules(s.Deny); err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+	for _, job := range jobNames {
+		if _, err := parseCron(s.schedule(job)); err != nil {
+			return fmt.Errorf("%v_schedule: %v", job, err)
+		}
+	}
+	return nil
+}
+
+func providerExists(name string) bool {
+	for _, p := range providers {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplySettings applies s now if no download or check is running, otherwise once the running one finishes so
+// in-flight checks keep the settings they started with. It returns true if s was applied now.
+func ApplySettings(s Settings) bool {
+	settings.Lock()
+	defer settings.Unlock()
+	if busy {
+		settings.pending = &s
+		return false
+	}
+	s.apply()
+	return true
+}
+
+// apply sets the globals from s. settings must be locked.
+func (s Settings) apply() {
+	Workers = s.Workers
+	Timeout = s.Timeout
+	DownloadTimeout = s.DownloadTimeout
+	Judges = s.Judges
+	DisabledProviders = s.DisabledProviders
+	RecheckMin = s.RecheckMin
+	RecheckMax = s.RecheckMax
+	Blocklists, Allow, Deny = s.Blocklists, s.Allow, s.Deny
+	if !equalStrings(s.Blocklists, settings.current.Blocklists) || !equalStrings(s.Allow, settings.current.Allow) ||
+		!equalStrings(s.Deny, settings.current.Deny) {
+		blocklistsChanged()
+	}
+	for _, job := range jobNames {
+		if s.schedule(job) != settings.current.schedule(job) {
+			select {
+			case settings.scheduleChanged <- struct{}{}:
+			default:
+			}
+			break
+		}
+	}
+	settings.current = s
+}
+
+// startJob waits for any running download or check, then marks the job name as running so settings changes
+// wait for it. It returns false without starting it if the server is shutting down.
+func startJob(name string) bool {
+	settings.job.Lock()
+	if stopping.Err() != nil {
+		settings.job.Unlock()
+		return false
+	}
+	settings.Lock()
+	busy = true
+	settings.jobID = fmt.Sprintf("%v-%v", name, time.Now().UTC().Format("20060102T150405"))
+	settings.Unlock()
+	return true
+}
+
+// finishJob marks the running download or check as done and applies any settings that were waiting for it.
+func finishJob() {
+	settings.Lock()
+	defer settings.job.Unlock()
+	defer settings.Unlock()
+	busy = false
+	settings.jobID = ""
+	if settings.pending != nil {
+		settings.pending.apply()
+		settings.pending = nil
+		logger.Info("Applied reloaded settings")
+	}
+}
+
+// reloadConfig is the admin handler for reloading the config file.
+func reloadConfig(c *gin.Context) {
+	if Reload == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"error": "reloading isn't supported"})
+		return
+	}
+	applied, err := Reload()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"applied": applied})
+}
+
+// job returns l with the id of the running job, if there is one.
+func (l *Logger) job() *Logger {
+	settings.Lock()
+	defer settings.Unlock()
+	if settings.jobID == "" {
+		return l
+	}
+	return l.With("job", settings.jobID)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplySettings(t *testing.T) {
+	s := Settings{Workers: 5, Timeout: time.Second, DownloadTimeout: time.Second, Interval: time.Hour,
+		RecheckMin: time.Minute, RecheckMax: time.Hour, DisabledProviders: []string{"us-proxy.org"}}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []Settings{
+		{Workers: 0, Timeout: time.Second, DownloadTimeout: time.Second, Interval: time.Hour},
+		{Workers: 1, Timeout: time.Second, DownloadTimeout: time.Second, Interval: time.Minute},
+		{Workers: 1, Timeout: time.Second, DownloadTimeout: time.Second, Interval: time.Hour, Judges: []string{"judge"}},
+		{Workers: 1, Timeout: time.Second, DownloadTimeout: time.Second, Interval: time.Hour, DisabledProviders: []string{"nope"}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("Validate(%+v) returned no error", bad)
+		}
+	}
+
+	if !ApplySettings(s) || Workers != 5 || !isDisabled("us-proxy.org") {
+		t.Fatalf("settings weren't applied when idle, workers %d", Workers)
+	}
+	select {
+	case <-settings.scheduleChanged:
+	default:
+		t.Error("changing the schedules didn't wake the scheduler")
+	}
+
+	// while a job runs, settings wait for it to finish.
+	startJob("test")
+	s.Workers = 10
+	if ApplySettings(s) {
+		t.Error("settings applied while busy")
+	}
+	if Workers != 5 {
+		t.Errorf("workers changed to %d while busy", Workers)
+	}
+	finishJob()
+	if Workers != 10 || busy {
+		t.Errorf("got workers %d busy %v after the job finished, want 10 false", Workers, busy)
+	}
+	ApplySettings(Settings{})
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// stopping is canceled when the server starts shutting down, which stops new jobs and cancels running checks.
+	stopping, stop = context.WithCancel(context.Background())
+	// stopped is closed when Shutdown has finished.
+	stopped = make(chan struct{})
+	// server is the api server, set by API unless the server is already shutting down.
+	server = struct {
+		sync.Mutex
+		http *http.Server
+	}{}
+)
+
+// Shutdown stops the server within timeout. It stops accepting requests and starting jobs, cancels the running
+// checks, waits for the running job to store the results it has and closes the db.
+func Shutdown(timeout time.Duration) error {
+	defer close(stopped)
+	stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// stop was called first, so API either set the server already or will see stopping and not serve.
+	server.Lock()
+	srv := server.http
+	server.Unlock()
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("Can't close connections", "err", err)
+		}
+	}
+	idle := make(chan struct{})
+	go func() {
+		settings.job.Lock()
+		settings.job.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		// the job may still be writing, so leave the db open.
+		return errors.New("timed out waiting for the running job, results it hasn't stored are lost")
+	}
+	return DB.Close()
+}
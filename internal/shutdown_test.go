@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	judgeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"origin": "1.1.1.1"}`)
+	}))
+	defer judgeSrv.Close()
+	fastProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"origin": "9.9.9.9"}`)
+	}))
+	defer fastProxy.Close()
+	var once sync.Once
+	slowStarted := make(chan struct{})
+	slowProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(slowStarted) })
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer slowProxy.Close()
+
+	defer testDB(t, Proxies{{Proxy: fastProxy.URL}, {Proxy: slowProxy.URL}})()
+	var alerts int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&alerts, 1)
+	}))
+	defer hook.Close()
+	if err := SetWebhooks([]*Webhook{{URL: hook.URL, Events: []string{AlertCheckFailed}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetWebhooks(nil)
+	Judges = []string{judgeSrv.URL}
+	Workers, Timeout = 2, 10*time.Second
+	defer func() {
+		Judges = nil
+		stopping, stop = context.WithCancel(context.Background())
+		stopped = make(chan struct{})
+	}()
+
+	go CheckInit(context.Background())
+	select {
+	case <-slowStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow proxy wasn't checked")
+	}
+	// wait for the fast proxy's result, which is stored with the batch.
+	for {
+		mutex.Lock()
+		pending := len(checkedProxies)
+		mutex.Unlock()
+		if pending > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if err := Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %v, want the running check canceled", d)
+	}
+	if startJob("test") {
+		t.Error("started a job after shutting down")
+	}
+	// the check cut short by shutdown isn't a failed cycle.
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&alerts); n != 0 {
+		t.Errorf("sent %d check_failed alerts for a check cut short by shutdown, want none", n)
+	}
+	// nor does the api start serving.
+	defer func() { LogFile = "" }()
+	LogFile = "-"
+	served := make(chan struct{})
+	go func() {
+		API()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("API served after shutting down")
+	}
+
+	// Shutdown closed the db, so open it again to see what was stored.
+	db, err := sql.Open("sqlite3", DbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for proxy, want := range map[string]struct {
+		status string
+		checks int
+	}{fastProxy.URL: {"good", 1}, slowProxy.URL: {"", 0}} {
+		var status sql.NullString
+		var checks int
+		err := db.QueryRow(`select last_status, check_count from proxies where proxy = $1`, proxy).Scan(&status, &checks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.String != want.status || checks != want.checks {
+			t.Errorf("%v stored with status %q after %d checks, want %q after %d", proxy, status.String, checks, want.status, want.checks)
+		}
+	}
+}
@@ -18,7 +18,6 @@ package internal
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/fatih/color"
 	"github.com/nicksherron/proxi/internal/fdlimit"
@@ -29,23 +28,16 @@ var (
 	FileLimitMax int
 )
 
-// TODO: Make proper error and logging. This is stupid.
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
 // IncrFdLimit attempts to increase max file handles per process
 func IncrFdLimit() (int, uint64) {
 	var newLimit uint64
 	oldLimit, err := fdlimit.Current()
 	if err != nil {
-		log.Fatalf("Failed to retrieve file descriptor allowance: %v", err)
+		logger.Fatal("Can't get the file descriptor limit", "err", err)
 	}
 	if oldLimit < FileLimitMax {
 		if newLimit, err = fdlimit.Raise(uint64(FileLimitMax)); err != nil {
-			log.Fatalf("Failed to raise file descriptor allowance: %v", err)
+			logger.Fatal("Can't raise the file descriptor limit", "err", err)
 		}
 	}
 	return oldLimit, newLimit
@@ -72,7 +64,7 @@ func StartupMessage() {
 	//fmt.Printf("Visit http://%v/swagger/index.html for api docs.", Addr)
 	//color.HiGreen(docsBanner)
 	fmt.Print("\n")
-	log.Printf("Listening and serving HTTP on %v", Addr)
+	apiLog.Info("Listening and serving HTTP", "addr", Addr)
 	fmt.Print("\n\n")
 
 }
@@ -0,0 +1,275 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook alert types.
+const (
+	AlertPoolLow          = "pool_low"
+	AlertCountryAnonEmpty = "country_anon_empty"
+	AlertProviderEmpty    = "provider_empty"
+	AlertCheckFailed      = "check_failed"
+
+	// SignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the payload, keyed with the webhook secret.
+	SignatureHeader = "X-Proxi-Signature"
+
+	webhookAttempts = 5
+)
+
+var (
+	// WebhooksFile is the path to a json file with a list of webhooks.
+	WebhooksFile string
+	// webhookBackoff is the wait before the first retry, doubled for each retry after.
+	webhookBackoff = time.Second
+	alertTypes     = map[string]bool{AlertPoolLow: true, AlertCountryAnonEmpty: true, AlertProviderEmpty: true, AlertCheckFailed: true}
+	webhooks       = struct {
+		sync.Mutex
+		hooks []*Webhook
+		// firing holds alerts already sent so they are only sent again after recovering.
+		firing map[string]bool
+		// providerEmpty counts consecutive empty runs per provider.
+		providerEmpty map[string]int
+	}{firing: make(map[string]bool), providerEmpty: make(map[string]int)}
+)
+
+// Webhook is an http endpoint that alerts are posted to.
+type Webhook struct {
+	URL    string `json:"url" yaml:"url"`
+	Secret string `json:"secret" yaml:"secret"`
+	// Events is the alert types sent to this webhook. Empty sends all.
+	Events []string `json:"events" yaml:"events"`
+	// GoodBelow fires pool_low when the number of good proxies drops below it.
+	GoodBelow int `json:"good_below" yaml:"good_below"`
+	// Countries fires country_anon_empty when one of them has no good anonymous proxies.
+	Countries []string `json:"countries" yaml:"countries"`
+	// ProviderEmptyRuns fires provider_empty when a provider returns no proxies this many downloads in a row.
+	ProviderEmptyRuns int `json:"provider_empty_runs" yaml:"provider_empty_runs"`
+}
+
+// Alert is the json payload posted to webhooks.
+type Alert struct {
+	Event   string                 `json:"event"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+func (w *Webhook) wants(alert string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == alert {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWebhooks checks the urls, events and thresholds of hooks and upper cases their countries.
+func ValidateWebhooks(hooks []*Webhook) error {
+	for i, w := range hooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %d: invalid url %q", i, w.URL)
+		}
+		for _, e := range w.Events {
+			if !alertTypes[e] {
+				return fmt.Errorf("webhook %d: unknown event %q", i, e)
+			}
+		}
+		if w.GoodBelow < 0 || w.ProviderEmptyRuns < 0 {
+			return fmt.Errorf("webhook %d: thresholds can't be negative", i)
+		}
+		for j, c := range w.Countries {
+			w.Countries[j] = strings.ToUpper(c)
+		}
+	}
+	return nil
+}
+
+// LoadWebhooks reads and validates WebhooksFile. A missing file disables webhooks.
+func LoadWebhooks() error {
+	var hooks []*Webhook
+	if WebhooksFile != "" {
+		b, err := ioutil.ReadFile(WebhooksFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &hooks); err != nil {
+				return fmt.Errorf("%v: %v", WebhooksFile, err)
+			}
+		}
+	}
+	return SetWebhooks(hooks)
+}
+
+// SetWebhooks validates and replaces the configured webhooks.
+func SetWebhooks(hooks []*Webhook) error {
+	if err := ValidateWebhooks(hooks); err != nil {
+		return err
+	}
+	webhooks.Lock()
+	webhooks.hooks = hooks
+	webhooks.Unlock()
+	return nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the alert, retrying with backoff on errors and 5xx or 429 responses.
+func sendWebhook(w *Webhook, a Alert) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		webhookLog.Error("Can't encode alert", "event", a.Event, "err", err)
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	wait := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+		if err != nil {
+			webhookLog.Error("Can't build webhook request", "url", w.URL, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "proxi/"+Version)
+		if w.Secret != "" {
+			req.Header.Set(SignatureHeader, signPayload(w.Secret, body))
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				if resp.StatusCode >= 300 {
+					webhookLog.Warn("Webhook rejected alert", "url", w.URL, "event", a.Event, "status", resp.Status)
+				}
+				return
+			}
+			err = fmt.Errorf("bad status: %s", resp.Status)
+		}
+		if attempt == webhookAttempts {
+			webhookLog.Error("Webhook failed", "url", w.URL, "event", a.Event, "attempts", attempt, "err", err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// setAlert sends an alert to webhooks that want it when cond becomes true. It's sent again only after
+// cond has been false. key identifies the alert per webhook, eg the country it's for. Alerts are tracked by the
+// webhook's url so they keep firing across reloads. webhooks must be locked.
+func setAlert(w *Webhook, key string, cond bool, a Alert) {
+	k := fmt.Sprintf("%v/%v/%v", w.URL, a.Event, key)
+	if !cond {
+		delete(webhooks.firing, k)
+		return
+	}
+	if webhooks.firing[k] || !w.wants(a.Event) {
+		return
+	}
+	webhooks.firing[k] = true
+	a.Time = time.Now()
+	go sendWebhook(w, a)
+}
+
+// checkAlerts evaluates the pool alerts after a check cycle.
+func checkAlerts(good int) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	for _, w := range webhooks.hooks {
+		if w.GoodBelow > 0 {
+			setAlert(w, "", good < w.GoodBelow, Alert{
+				Event:   AlertPoolLow,
+				Message: fmt.Sprintf("%d good proxies, below threshold of %d", good, w.GoodBelow),
+				Data:    map[string]interface{}{"good": good, "threshold": w.GoodBelow},
+			})
+		}
+		for _, country := range w.Countries {
+			var n int
+			err := DB.QueryRow(`select count(*) from proxies where deleted = false and last_status = 'good'
+ 									and anonymous and country = $1`, country).Scan(&n)
+			if err != nil {
+				webhookLog.Error("Can't count good proxies", "err", err)
+				continue
+			}
+			setAlert(w, country, n == 0, Alert{
+				Event:   AlertCountryAnonEmpty,
+				Message: fmt.Sprintf("no good anonymous proxies for %v", country),
+				Data:    map[string]interface{}{"country": country},
+			})
+		}
+	}
+}
+
+// cycleAlert sends the check_failed alert when err, why a check cycle couldn't run or finish, isn't nil, and
+// clears it after a cycle that finished.
+func cycleAlert(err error) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	for _, w := range webhooks.hooks {
+		a := Alert{Event: AlertCheckFailed}
+		if err != nil {
+			a.Message = fmt.Sprintf("check cycle failed: %v", err)
+			a.Data = map[string]interface{}{"error": err.Error()}
+		}
+		setAlert(w, "", err != nil, a)
+	}
+}
+
+// providerAlerts tracks consecutive empty downloads from a provider.
+func providerAlerts(name string, found int) {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	if found == 0 {
+		webhooks.providerEmpty[name]++
+	} else {
+		webhooks.providerEmpty[name] = 0
+	}
+	runs := webhooks.providerEmpty[name]
+	for _, w := range webhooks.hooks {
+		if w.ProviderEmptyRuns == 0 {
+			continue
+		}
+		setAlert(w, name, runs >= w.ProviderEmptyRuns, Alert{
+			Event:   AlertProviderEmpty,
+			Message: fmt.Sprintf("provider %v returned no proxies %d times in a row", name, runs),
+			Data:    map[string]interface{}{"provider": name, "runs": runs},
+		})
+	}
+}
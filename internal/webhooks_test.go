@@ -0,0 +1,110 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	var attempts int32
+	alerts := make(chan Alert, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != signPayload("secret", body) {
+			t.Errorf("bad signature %q", r.Header.Get(SignatureHeader))
+		}
+		// fail the first attempt to test retries
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var a Alert
+		json.Unmarshal(body, &a)
+		alerts <- a
+	}))
+	defer ts.Close()
+
+	if err := SetWebhooks([]*Webhook{{URL: "ftp://example.com"}}); err == nil {
+		t.Error("SetWebhooks with ftp url returned no error")
+	}
+	if err := SetWebhooks([]*Webhook{{URL: ts.URL, Events: []string{"everything"}}}); err == nil {
+		t.Error("SetWebhooks with unknown event returned no error")
+	}
+	err := SetWebhooks([]*Webhook{{URL: ts.URL, Secret: "secret", Events: []string{AlertPoolLow, AlertProviderEmpty}, GoodBelow: 10, ProviderEmptyRuns: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetWebhooks(nil)
+
+	// check_failed isn't subscribed to, and pool_low is only sent once until it recovers.
+	checkAlerts(0)
+	checkAlerts(5)
+	a := <-alerts
+	if a.Event != AlertPoolLow {
+		t.Errorf("alert = %v; want %v", a.Event, AlertPoolLow)
+	}
+
+	providerAlerts("example.com", 0)
+	providerAlerts("example.com", 0)
+	providerAlerts("example.com", 0)
+	a = <-alerts
+	if a.Event != AlertProviderEmpty || a.Data["provider"] != "example.com" {
+		t.Errorf("alert = %+v; want %v for example.com", a, AlertProviderEmpty)
+	}
+
+	checkAlerts(50)
+	checkAlerts(5)
+	if a = <-alerts; a.Event != AlertPoolLow {
+		t.Errorf("alert after recovering = %v; want %v", a.Event, AlertPoolLow)
+	}
+	// reloading the webhooks doesn't send alerts that are already firing again.
+	err = SetWebhooks([]*Webhook{{URL: ts.URL, Secret: "secret", Events: []string{AlertPoolLow}, GoodBelow: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAlerts(5)
+
+	// check_failed is sent for cycles that fail rather than ones that find no good proxies, once until one finishes.
+	if err := SetWebhooks([]*Webhook{{URL: ts.URL, Secret: "secret", Events: []string{AlertCheckFailed}}}); err != nil {
+		t.Fatal(err)
+	}
+	checkAlerts(0)
+	cycleAlert(errors.New("can't connect to the judges"))
+	cycleAlert(errors.New("can't connect to the judges"))
+	if a = <-alerts; a.Event != AlertCheckFailed || a.Data["error"] != "can't connect to the judges" {
+		t.Errorf("alert = %+v; want %v for the judges", a, AlertCheckFailed)
+	}
+	cycleAlert(nil)
+	cycleAlert(errors.New("can't store check results: database is locked"))
+	if a = <-alerts; a.Event != AlertCheckFailed {
+		t.Errorf("alert after a finished cycle = %v; want %v", a.Event, AlertCheckFailed)
+	}
+
+	select {
+	case a := <-alerts:
+		t.Errorf("unexpected alert %+v", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
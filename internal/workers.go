@@ -0,0 +1,345 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultRegion labels workers that don't set a region.
+	defaultRegion = "default"
+	// workerLease is how long leased proxies wait for results before being handed to another worker.
+	workerLease       = 10 * time.Minute
+	defaultLeaseLimit = 100
+	maxLeaseLimit     = 1000
+)
+
+// RegionCheck is the latest check of a proxy by a worker in a region.
+type RegionCheck struct {
+	ID           uint       `json:"-" gorm:"primary_key"`
+	ProxyID      uint       `json:"-" gorm:"unique_index:idx_region_check"`
+	Region       string     `json:"region" gorm:"unique_index:idx_region_check"`
+	Worker       string     `json:"worker"`
+	Status       string     `json:"status"`
+	Anonymous    bool       `json:"anonymous"`
+	LatencyMs    int64      `json:"latency_ms" gorm:"default:0"`
+	LosingStreak uint       `json:"-" gorm:"default:0"`
+	CheckedAt    *time.Time `json:"checked_at"`
+	NextCheckAt  time.Time  `json:"-"`
+	// LeasedUntil is when the lease of Worker expires, nil when the proxy isn't leased.
+	LeasedUntil *time.Time `json:"-"`
+}
+
+// Worker is a checker that leases proxies from the server, see 'proxi worker'.
+type Worker struct {
+	Name     string    `json:"name" gorm:"primary_key"`
+	Region   string    `json:"region"`
+	LastSeen time.Time `json:"last_seen"`
+	Checked  int64     `json:"checked" gorm:"default:0"`
+	Good     int64     `json:"good" gorm:"default:0"`
+}
+
+// WorkerTask is a proxy leased to a worker to check.
+type WorkerTask struct {
+	ID    uint   `json:"id"`
+	Proxy string `json:"proxy"`
+}
+
+// WorkerResult is the outcome of a WorkerTask.
+type WorkerResult struct {
+	ID        uint   `json:"id" binding:"required"`
+	Status    string `json:"status" binding:"required"`
+	Anonymous bool   `json:"anonymous"`
+	LatencyMs int64  `json:"latency_ms"`
+	// ExitIP is the address the judge saw the check come from.
+	ExitIP string `json:"exit_ip"`
+	// Error is why the check failed, like proxyCheck's last_error.
+	Error string `json:"error"`
+}
+
+type workerRequest struct {
+	Worker  string          `json:"worker" binding:"required"`
+	Region  string          `json:"region"`
+	Limit   int             `json:"limit"`
+	Results []*WorkerResult `json:"results"`
+}
+
+func bindWorkerRequest(c *gin.Context) (*workerRequest, bool) {
+	var req workerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if req.Region == "" {
+		req.Region = defaultRegion
+	}
+	return &req, true
+}
+
+// leaseProxies returns up to limit proxies due to be checked from region and marks them leased to worker until
+// now plus workerLease, so other workers in the region don't check them too. The proxies are picked and leased in
+// one transaction, with the picked rows locked on postgres so other replicas skip them.
+func leaseProxies(worker, region string, limit int, now time.Time) ([]*WorkerTask, error) {
+	query := `select p.id, p.proxy from proxies p
+ 							left join region_checks rc on rc.proxy_id = p.id and rc.region = $1
+ 							where p.deleted = false and (rc.id is null or rc.next_check_at <= $2)
+ 							order by rc.next_check_at is not null, rc.next_check_at limit $3`
+	if highAvailability() {
+		query += " for update of p skip locked"
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(query, region, now, limit)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var tasks []*WorkerTask
+	for rows.Next() {
+		var t WorkerTask
+		if err := rows.Scan(&t.ID, &t.Proxy); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		tasks = append(tasks, &t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	until := now.Add(workerLease)
+	for _, t := range tasks {
+		_, err := tx.Exec(`insert into region_checks("proxy_id", "region", "worker", "status", "next_check_at", "leased_until")
+ 								values($1,$2,$3,'',$4,$4)
+ 								on conflict (proxy_id, region) do update set worker = excluded.worker,
+ 								next_check_at = excluded.next_check_at, leased_until = excluded.leased_until`, t.ID, region, worker, until)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := touchWorker(tx, worker, region, 0, 0); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tasks, tx.Commit()
+}
+
+// releaseLease ends the lease of proxy id to worker in region, returning false if the proxy isn't leased to
+// the worker, so a result is only recorded once and only from the worker it was handed to.
+func releaseLease(worker, region string, id uint, now time.Time) (bool, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	res, err := DB.Exec(`update region_checks set leased_until = null
+ 							where proxy_id = $1 and region = $2 and worker = $3 and leased_until >= $4`, id, region, worker, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func validateWorkerResults(results []*WorkerResult) error {
+	for _, r := range results {
+		if r.Status != "good" && r.Status != "fail" && r.Status != "timeout" && r.Status != "error" {
+			return fmt.Errorf("proxy %d: invalid status %q", r.ID, r.Status)
+		}
+	}
+	return nil
+}
+
+// recordWorkerResults stores results from a worker in region, updating both the region checks and the
+// proxies so workers can replace the server's own checks. Results for proxies not leased to the worker are
+// skipped, and the number recorded is returned. Failures outside the default region only count against the
+// region, as a proxy that can't be reached from one place may work from others.
+func recordWorkerResults(worker, region string, results []*WorkerResult) (int, error) {
+	var good, recorded int64
+	geo := openGeo()
+	defer geo.Close()
+	for _, r := range results {
+		leased, err := releaseLease(worker, region, r.ID, time.Now())
+		if err != nil {
+			return int(recorded), err
+		}
+		if !leased {
+			workerLog.Warn("Rejected result for a proxy not leased to the worker", "worker", worker, "region", region, "id", r.ID)
+			continue
+		}
+		recorded++
+		if r.Status == "good" {
+			good++
+		}
+		if err := storeRegionCheck(worker, region, r); err != nil {
+			return int(recorded), err
+		}
+		if region != defaultRegion && r.Status != "good" {
+			continue
+		}
+		mutex.Lock()
+		checking := serverChecks[r.ID]
+		mutex.Unlock()
+		if checking {
+			// the running check cycle would store its own result over this one.
+			continue
+		}
+		found := dbFind("id = $1", r.ID)
+		if len(found) == 0 {
+			continue
+		}
+		proxy := found[0]
+		prevStatus := proxy.LastStatus
+		proxy.CheckCount++
+		if retire(proxy) {
+			proxy.Deleted = true
+		} else {
+			recordResult(proxy, r.Status, r.Anonymous, time.Duration(r.LatencyMs)*time.Millisecond, r.Error)
+			if r.Status == "good" {
+				geo.locateExit(proxy, r.ExitIP)
+			}
+			tagBlocked(proxy)
+		}
+		proxy.Judge = "worker:" + worker
+		dbInsert(proxy)
+		observeCheck(proxy, time.Duration(r.LatencyMs)*time.Millisecond)
+		publishCheck(proxy, prevStatus)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return int(recorded), touchWorker(DB, worker, region, recorded, good)
+}
+
+func storeRegionCheck(worker, region string, r *WorkerResult) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var (
+		streak    uint
+		status    string
+		anonymous bool
+	)
+	err := DB.QueryRow(`select losing_streak, status, coalesce(anonymous, false) from region_checks where proxy_id = $1 and region = $2`,
+		r.ID, region).Scan(&streak, &status, &anonymous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	switch r.Status {
+	case "good":
+		streak = 0
+		status, anonymous = r.Status, r.Anonymous
+	case "error":
+		// the judge failed, so the region's last result stands.
+	default:
+		streak++
+		status, anonymous = r.Status, r.Anonymous
+	}
+	now := time.Now()
+	next := now.Add(nextCheck(&Proxy{LastStatus: status, LosingStreak: streak}))
+	_, err = DB.Exec(`insert into region_checks("proxy_id", "region", "worker", "status", "anonymous", "latency_ms",
+ 							"losing_streak", "checked_at", "next_check_at") values($1,$2,$3,$4,$5,$6,$7,$8,$9)
+ 							on conflict (proxy_id, region) do update set worker = excluded.worker, status = excluded.status,
+ 							anonymous = excluded.anonymous, latency_ms = excluded.latency_ms,
+ 							losing_streak = excluded.losing_streak, checked_at = excluded.checked_at,
+ 							next_check_at = excluded.next_check_at`,
+		r.ID, region, worker, status, anonymous, r.LatencyMs, streak, now, next)
+	return err
+}
+
+// touchWorker records that worker was seen and adds to its counts. mutex must be locked.
+func touchWorker(db execer, worker, region string, checked, good int64) error {
+	_, err := db.Exec(`insert into workers("name", "region", "last_seen", "checked", "good") values($1,$2,$3,$4,$5)
+ 							on conflict (name) do update set region = excluded.region, last_seen = excluded.last_seen,
+ 							checked = workers.checked + excluded.checked, good = workers.good + excluded.good`,
+		worker, region, time.Now(), checked, good)
+	return err
+}
+
+func getWorkers() ([]*Worker, error) {
+	rows, err := DB.Query(`select "name", "region", "last_seen", "checked", "good" from workers order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	workers := []*Worker{}
+	for rows.Next() {
+		var w Worker
+		if err := rows.Scan(&w.Name, &w.Region, &w.LastSeen, &w.Checked, &w.Good); err != nil {
+			return nil, err
+		}
+		workers = append(workers, &w)
+	}
+	return workers, rows.Err()
+}
+
+// leaseHandler hands a worker a batch of proxies to check.
+func leaseHandler(c *gin.Context) {
+	req, ok := bindWorkerRequest(c)
+	if !ok {
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultLeaseLimit
+	}
+	if req.Limit > maxLeaseLimit {
+		req.Limit = maxLeaseLimit
+	}
+	tasks, err := leaseProxies(req.Worker, req.Region, req.Limit, time.Now())
+	if err != nil {
+		workerLog.Error("Can't lease proxies", "worker", req.Worker, "err", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tasks == nil {
+		tasks = []*WorkerTask{}
+	}
+	c.IndentedJSON(http.StatusOK, tasks)
+}
+
+// resultsHandler stores the results of a worker's batch.
+func resultsHandler(c *gin.Context) {
+	req, ok := bindWorkerRequest(c)
+	if !ok {
+		return
+	}
+	if err := validateWorkerResults(req.Results); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recorded, err := recordWorkerResults(req.Worker, req.Region, req.Results)
+	if err != nil {
+		workerLog.Error("Can't record results", "worker", req.Worker, "err", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"recorded": recorded, "rejected": len(req.Results) - recorded})
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerLease(t *testing.T) {
+	RecheckMin, RecheckMax = time.Hour, 24*time.Hour
+	defer func() { RecheckMin, RecheckMax = 0, 0 }()
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", LastStatus: "fail"},
+		{Proxy: "http://2.2.2.2:80", LastStatus: "fail"},
+		{Proxy: "http://3.3.3.3:80", LastStatus: "fail"},
+	})()
+	now := time.Now()
+	tasks, err := leaseProxies("w1", "us", 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("leased %d proxies, want 2", len(tasks))
+	}
+	// leased proxies aren't handed to other workers in the region until the lease expires, but are to other regions.
+	if rest, _ := leaseProxies("w2", "us", 10, now); len(rest) != 1 {
+		t.Errorf("second lease in region got %d proxies, want 1", len(rest))
+	}
+	if other, _ := leaseProxies("w3", "eu", 10, now); len(other) != 3 {
+		t.Errorf("lease in another region got %d proxies, want 3", len(other))
+	}
+
+	recorded, err := recordWorkerResults("w1", "us", []*WorkerResult{
+		{ID: tasks[0].ID, Status: "good", Anonymous: true, LatencyMs: 250},
+		{ID: tasks[1].ID, Status: "timeout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 2 {
+		t.Errorf("recorded %d results, want 2", recorded)
+	}
+	// results are only taken once and from the worker holding the lease.
+	recorded, err = recordWorkerResults("w2", "us", []*WorkerResult{
+		{ID: tasks[0].ID, Status: "fail"},
+		{ID: tasks[1].ID, Status: "good"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := recordWorkerResults("w1", "us", []*WorkerResult{{ID: tasks[0].ID, Status: "fail"}}); recorded != 0 || again != 0 {
+		t.Errorf("recorded %d results from another worker and %d again, want none", recorded, again)
+	}
+
+	got, err := queryProxies(ProxyFilter{Regions: []string{"us"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != tasks[0].ID || got[0].LastStatus != "good" || !got[0].Anonymous || got[0].RespTime == nil || *got[0].RespTime != "250ms" {
+		t.Fatalf("region us proxies = %+v, want the good one", got)
+	}
+	if got, _ := queryProxies(ProxyFilter{Regions: []string{"eu"}}); len(got) != 0 {
+		t.Errorf("region eu has %d good proxies, want 0", len(got))
+	}
+	// failures in a region don't count against the proxy elsewhere.
+	if p := dbFind("id = $1", tasks[1].ID); len(p) != 1 || p[0].CheckCount != 0 || p[0].LosingStreak != 0 || p[0].LastStatus != "fail" {
+		t.Errorf("proxy that timed out in us = %+v, want it unchanged", p)
+	}
+
+	// checked proxies aren't due again until their next check, only the one leased without results is.
+	if expired, _ := leaseProxies("w2", "us", 10, now.Add(workerLease+time.Second)); len(expired) != 1 {
+		t.Errorf("lease after expiry got %d proxies, want 1", len(expired))
+	}
+
+	workers, err := getWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 3 || workers[0].Name != "w1" || workers[0].Checked != 2 || workers[0].Good != 1 {
+		t.Errorf("workers = %+v, want w1 with 2 checked and 1 good first", workers[0])
+	}
+	if validateWorkerResults([]*WorkerResult{{ID: 1, Status: "maybe"}}) == nil {
+		t.Error("invalid status accepted")
+	}
+}
+
+func TestWorkerResultsDuringServerCheck(t *testing.T) {
+	RecheckMin, RecheckMax = time.Hour, 24*time.Hour
+	defer func() { RecheckMin, RecheckMax = 0, 0 }()
+	defer testDB(t, Proxies{
+		{Proxy: "http://1.1.1.1:80", LastStatus: "fail"},
+		{Proxy: "http://2.2.2.2:80", LastStatus: "fail"},
+	})()
+	tasks, err := leaseProxies("w1", defaultRegion, 2, time.Now())
+	if err != nil || len(tasks) != 2 {
+		t.Fatalf("leased %d proxies, %v; want 2", len(tasks), err)
+	}
+	mutex.Lock()
+	serverChecks[tasks[0].ID] = true
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(serverChecks, tasks[0].ID)
+		mutex.Unlock()
+	}()
+
+	recorded, err := recordWorkerResults("w1", defaultRegion, []*WorkerResult{
+		{ID: tasks[0].ID, Status: "good", LatencyMs: 100},
+		{ID: tasks[1].ID, Status: "good", LatencyMs: 100},
+	})
+	if err != nil || recorded != 2 {
+		t.Fatalf("recorded %d results, %v; want 2", recorded, err)
+	}
+	// the proxy in the server's check cycle is left for the cycle to store.
+	if p := dbFind("id = $1", tasks[0].ID); len(p) != 1 || p[0].CheckCount != 0 || p[0].LastStatus != "fail" {
+		t.Errorf("proxy in a server check = %+v, want it unchanged", p)
+	}
+	if p := dbFind("id = $1", tasks[1].ID); len(p) != 1 || p[0].CheckCount != 1 || p[0].LastStatus != "good" {
+		t.Errorf("proxy not in a server check = %+v, want it checked good", p)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nicksherron/proxi/client"
+)
+
+// Source provides proxies to a Rotator and receives the outcome of requests sent through them.
+type Source interface {
+	// Proxies returns up to n proxy urls, eg http://1.2.3.4:8080.
+	Proxies(ctx context.Context, n int) ([]string, error)
+	// Report records whether a request through proxy succeeded.
+	Report(ctx context.Context, proxy string, ok bool) error
+}
+
+// ClientSource gets proxies matching Filter from a proxi server.
+type ClientSource struct {
+	Client *client.Client
+	Filter *client.Filter
+}
+
+// Proxies implements Source.
+func (s *ClientSource) Proxies(ctx context.Context, n int) ([]string, error) {
+	proxies, err := s.Client.GetN(ctx, n, s.Filter)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		out = append(out, p.Proxy)
+	}
+	return out, nil
+}
+
+// Report implements Source.
+func (s *ClientSource) Report(ctx context.Context, proxy string, ok bool) error {
+	return s.Client.Report(ctx, proxy, ok)
+}
+
+// DBSource gets good proxies directly from a proxi db opened with the sqlite3 or postgres driver.
+type DBSource struct {
+	DB *sql.DB
+	// Anon only returns anonymous proxies.
+	Anon bool
+	// Countries only returns proxies in these countries, eg US.
+	Countries []string
+}
+
+// Proxies implements Source.
+func (s *DBSource) Proxies(ctx context.Context, n int) ([]string, error) {
+	query := `select proxy from proxies where deleted = false and last_status = 'good' and blocked = ''`
+	// sqlite binds $n parameters in the order they appear, so args are added in the order of their placeholders.
+	var args []interface{}
+	if s.Anon {
+		query += ` and anonymous`
+	}
+	if len(s.Countries) != 0 {
+		var in []string
+		for _, c := range s.Countries {
+			args = append(args, strings.ToUpper(c))
+			in = append(in, fmt.Sprintf("$%d", len(args)))
+		}
+		query += fmt.Sprintf(` and country in (%v)`, strings.Join(in, ", "))
+	}
+	args = append(args, n)
+	query += fmt.Sprintf(` order by random() limit $%d`, len(args))
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Report implements Source.
+func (s *DBSource) Report(ctx context.Context, proxy string, ok bool) error {
+	column := "report_fail"
+	if ok {
+		column = "report_ok"
+	}
+	_, err := s.DB.ExecContext(ctx, fmt.Sprintf(`update proxies set %[1]v = %[1]v + 1 where proxy = $1`, column), proxy)
+	return err
+}
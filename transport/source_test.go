@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDBSource(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// an in memory db is per connection.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`create table proxies (proxy text, deleted bool default false, last_status text, blocked text default '',
+ 							anonymous bool default false, country text, report_ok integer default 0, report_fail integer default 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []struct {
+		proxy, status, country, blocked string
+		anon                            bool
+	}{
+		{"http://1.1.1.1:80", "good", "US", "", true},
+		{"http://2.2.2.2:80", "good", "DE", "", true},
+		{"http://3.3.3.3:80", "good", "US", "", false},
+		{"http://4.4.4.4:80", "fail", "US", "", true},
+		{"http://5.5.5.5:80", "good", "US", "spamhaus", true},
+		{"http://6.6.6.6:80", "good", "FR", "", true},
+	} {
+		_, err := db.Exec(`insert into proxies (proxy, last_status, country, blocked, anonymous) values ($1, $2, $3, $4, $5)`,
+			p.proxy, p.status, p.country, p.blocked, p.anon)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	src := &DBSource{DB: db, Anon: true, Countries: []string{"us", "de"}}
+	got, err := src.Proxies(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "http://1.1.1.1:80" || got[1] != "http://2.2.2.2:80" {
+		t.Errorf("Proxies() = %v; want the good anonymous proxies in US and DE", got)
+	}
+	if got, err := src.Proxies(ctx, 1); err != nil || len(got) != 1 {
+		t.Errorf("Proxies(1) = %v, %v; want 1 proxy", got, err)
+	}
+	if got, err := (&DBSource{DB: db}).Proxies(ctx, 10); err != nil || len(got) != 4 {
+		t.Errorf("Proxies() without filters = %v, %v; want the 4 good proxies", got, err)
+	}
+
+	if err := src.Report(ctx, "http://1.1.1.1:80", false); err != nil {
+		t.Fatal(err)
+	}
+	var fails int
+	if err := db.QueryRow(`select report_fail from proxies where proxy = 'http://1.1.1.1:80'`).Scan(&fails); err != nil || fails != 1 {
+		t.Errorf("report_fail = %d, %v; want 1", fails, err)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transport provides the http transport proxi checks proxies with and a RoundTripper
+// that rotates requests over proxies from a proxi server or db.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UserAgent is the browser User-Agent proxies are checked with.
+const UserAgent = `Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36`
+
+const reportTimeout = 30 * time.Second
+
+// Rotation modes.
+const (
+	// PerRequest uses the next proxy in the pool for each request.
+	PerRequest = iota
+	// PerHost sends all requests to a host through the same proxy until it fails.
+	PerHost
+)
+
+// ErrNoProxies is returned when the source has no usable proxies.
+var ErrNoProxies = errors.New("no proxies available")
+
+// ForProxy returns the transport used to send requests through proxyURL. Certificates aren't verified since
+// proxies are untrusted anyway and many judge and target sites have broken chains.
+func ForProxy(proxyURL *url.URL) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyURL(proxyURL),
+		TLSHandshakeTimeout: 60 * time.Second,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// Rotator is an http.RoundTripper that sends each request through a proxy from Source, retrying failed
+// requests with another proxy and reporting outcomes back to Source.
+type Rotator struct {
+	Source Source
+	// Mode is PerRequest or PerHost.
+	Mode int
+	// Retries is the number of other proxies tried after a failed attempt. Requests with a body are
+	// only retried if req.GetBody is set.
+	Retries int
+	// PoolSize is the number of proxies fetched from Source at a time. Defaults to 20.
+	PoolSize int
+	// Failed decides if an attempt failed. Defaults to DefaultFailed.
+	Failed func(*http.Response, error) bool
+	// Timeout limits each attempt, including reading the response body, so a dead proxy doesn't use up
+	// the whole request timeout. 0 means no limit.
+	Timeout time.Duration
+	// Attempted is called after each attempt with the proxy used and whether it succeeded.
+	Attempted func(proxy string, ok bool)
+
+	mu         sync.Mutex
+	pool       []string
+	next       int
+	hosts      map[string]string
+	transports map[string]*http.Transport
+}
+
+// NewRotator returns a Rotator over source with 2 retries.
+func NewRotator(source Source, mode int) *Rotator {
+	return &Rotator{Source: source, Mode: mode, Retries: 2}
+}
+
+// DefaultFailed treats errors and responses a proxy likely caused as failures: 407, 429 and 502-504.
+func DefaultFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusProxyAuthRequired, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Rotator) RoundTrip(req *http.Request) (*http.Response, error) {
+	failed := r.Failed
+	if failed == nil {
+		failed = DefaultFailed
+	}
+	tried := make(map[string]bool)
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, berr
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		proxy, tr, perr := r.pick(req, tried)
+		if perr != nil {
+			if resp != nil || err != nil {
+				break
+			}
+			return nil, perr
+		}
+		tried[proxy] = true
+		if resp != nil {
+			resp.Body.Close()
+		}
+		resp, err = r.attempt(tr, req)
+		ok := !failed(resp, err)
+		if r.Attempted != nil {
+			r.Attempted(proxy, ok)
+		}
+		go r.report(proxy, ok)
+		if ok || req.Context().Err() != nil {
+			break
+		}
+		r.drop(proxy)
+	}
+	return resp, err
+}
+
+// attempt sends req with tr, applying the attempt timeout.
+func (r *Rotator) attempt(tr *http.Transport, req *http.Request) (*http.Response, error) {
+	if r.Timeout <= 0 {
+		return tr.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), r.Timeout)
+	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the attempt's context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (r *Rotator) report(proxy string, ok bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	r.Source.Report(ctx, proxy, ok)
+}
+
+// pick returns a proxy not in tried and its transport, fetching more proxies from Source when needed.
+func (r *Rotator) pick(req *http.Request, tried map[string]bool) (string, *http.Transport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string]string)
+		r.transports = make(map[string]*http.Transport)
+	}
+	host := req.URL.Host
+	if p, ok := r.hosts[host]; ok && r.Mode == PerHost && !tried[p] {
+		return p, r.transports[p], nil
+	}
+
+	var proxy string
+	for refilled := false; proxy == ""; {
+		for i := 0; i < len(r.pool); i++ {
+			p := r.pool[(r.next+i)%len(r.pool)]
+			if !tried[p] {
+				proxy = p
+				r.next = (r.next + i + 1) % len(r.pool)
+				break
+			}
+		}
+		if proxy != "" {
+			break
+		}
+		if refilled {
+			return "", nil, ErrNoProxies
+		}
+		if err := r.refill(req, tried); err != nil {
+			return "", nil, err
+		}
+		refilled = true
+	}
+	if r.Mode == PerHost {
+		r.hosts[host] = proxy
+	}
+	return proxy, r.transports[proxy], nil
+}
+
+// refill adds proxies from Source to the pool. r.mu must be held.
+func (r *Rotator) refill(req *http.Request, tried map[string]bool) error {
+	n := r.PoolSize
+	if n <= 0 {
+		n = 20
+	}
+	proxies, err := r.Source.Proxies(req.Context(), n)
+	if err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		if _, ok := r.transports[p]; ok || tried[p] {
+			continue
+		}
+		u, err := url.Parse(p)
+		if err != nil {
+			continue
+		}
+		r.transports[p] = ForProxy(u)
+		r.pool = append(r.pool, p)
+	}
+	return nil
+}
+
+// drop removes a failed proxy from the pool.
+func (r *Rotator) drop(proxy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, p := range r.pool {
+		if p == proxy {
+			r.pool = append(r.pool[:i], r.pool[i+1:]...)
+			if r.next > i {
+				r.next--
+			}
+			break
+		}
+	}
+	for host, p := range r.hosts {
+		if p == proxy {
+			delete(r.hosts, host)
+		}
+	}
+	if tr, ok := r.transports[proxy]; ok {
+		tr.CloseIdleConnections()
+		delete(r.transports, proxy)
+	}
+}
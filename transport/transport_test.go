@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource hands out a fixed list of proxies and records reports.
+type fakeSource struct {
+	sync.Mutex
+	proxies []string
+	reports map[string][]bool
+}
+
+func (s *fakeSource) Proxies(ctx context.Context, n int) ([]string, error) {
+	return s.proxies, nil
+}
+
+func (s *fakeSource) Report(ctx context.Context, proxy string, ok bool) error {
+	s.Lock()
+	defer s.Unlock()
+	s.reports[proxy] = append(s.reports[proxy], ok)
+	return nil
+}
+
+func (s *fakeSource) reported(proxy string) []bool {
+	s.Lock()
+	defer s.Unlock()
+	return append([]bool(nil), s.reports[proxy]...)
+}
+
+// fakeProxy answers proxied requests itself with status and its name in the body.
+func fakeProxy(name string, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%v %v", name, r.URL.Host)
+	}))
+}
+
+func get(t *testing.T, c *http.Client, u string) string {
+	t.Helper()
+	resp, err := c.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func waitReports(t *testing.T, s *fakeSource, proxy string, want []bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := s.reported(proxy)
+		if fmt.Sprint(got) == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reports for %v = %v; want %v", proxy, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotator(t *testing.T) {
+	bad := fakeProxy("bad", http.StatusBadGateway)
+	defer bad.Close()
+	good1 := fakeProxy("good1", http.StatusOK)
+	defer good1.Close()
+	good2 := fakeProxy("good2", http.StatusOK)
+	defer good2.Close()
+
+	src := &fakeSource{proxies: []string{bad.URL, good1.URL, good2.URL}, reports: make(map[string][]bool)}
+	c := &http.Client{Transport: NewRotator(src, PerRequest)}
+
+	// the bad proxy is tried first, reported and dropped for the next one.
+	if got := get(t, c, "http://example.com/"); got != "good1 example.com" {
+		t.Errorf("first request = %q; want good1", got)
+	}
+	if got := get(t, c, "http://example.com/"); got != "good2 example.com" {
+		t.Errorf("second request = %q; want good2", got)
+	}
+	if got := get(t, c, "http://example.com/"); got != "good1 example.com" {
+		t.Errorf("third request = %q; want good1", got)
+	}
+	waitReports(t, src, bad.URL, []bool{false})
+	waitReports(t, src, good1.URL, []bool{true, true})
+
+	src = &fakeSource{proxies: []string{good1.URL, good2.URL}, reports: make(map[string][]bool)}
+	c = &http.Client{Transport: NewRotator(src, PerHost)}
+	for i := 0; i < 3; i++ {
+		if got := get(t, c, "http://a.example.com/"); got != "good1 a.example.com" {
+			t.Errorf("request %d to a = %q; want good1", i, got)
+		}
+		if got := get(t, c, "http://b.example.com/"); got != "good2 b.example.com" {
+			t.Errorf("request %d to b = %q; want good2", i, got)
+		}
+	}
+
+	src = &fakeSource{proxies: []string{bad.URL}, reports: make(map[string][]bool)}
+	c = &http.Client{Transport: NewRotator(src, PerRequest)}
+	resp, err := c.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status with only failing proxies = %d; want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	waitReports(t, src, bad.URL, []bool{false})
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hanging.Close()
+	src = &fakeSource{proxies: []string{hanging.URL, good1.URL}, reports: make(map[string][]bool)}
+	rt := NewRotator(src, PerRequest)
+	rt.Timeout = 100 * time.Millisecond
+	var attempts []bool
+	rt.Attempted = func(proxy string, ok bool) { attempts = append(attempts, ok) }
+	c = &http.Client{Transport: rt}
+	if got := get(t, c, "http://example.com/"); got != "good1 example.com" {
+		t.Errorf("request after hanging proxy = %q; want good1", got)
+	}
+	if fmt.Sprint(attempts) != "[false true]" {
+		t.Errorf("attempts = %v; want [false true]", attempts)
+	}
+
+	src = &fakeSource{reports: make(map[string][]bool)}
+	c = &http.Client{Transport: NewRotator(src, PerRequest)}
+	if _, err := c.Get("http://example.com/"); err == nil {
+		t.Error("request without proxies returned no error")
+	}
+}